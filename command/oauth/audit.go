@@ -0,0 +1,106 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/cli/errs"
+)
+
+// Defaults of the --audit-log-max-size and --audit-log-max-files flags.
+const (
+	defaultAuditLogMaxSize  = 10 << 20
+	defaultAuditLogMaxFiles = 5
+)
+
+// auditRecord is the line appended to the --audit-log file on each run. It
+// must never include the tokens.
+type auditRecord struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Provider    string    `json:"provider,omitempty"`
+	Flow        string    `json:"flow"`
+	Scope       string    `json:"scope,omitempty"`
+	TokenSHA256 string    `json:"token_sha256"`
+}
+
+// newAuditRecord returns the audit record of a token issued at the given
+// time. If the token does not have a scope, the requested one is used.
+func newAuditRecord(provider, flow, scope string, tok *token, issuedAt time.Time) *auditRecord {
+	if tok.Scope != "" {
+		scope = tok.Scope
+	}
+	sum := sha256.Sum256([]byte(tok.AccessToken))
+	return &auditRecord{
+		Timestamp:   issuedAt.UTC(),
+		Provider:    provider,
+		Flow:        flow,
+		Scope:       scope,
+		TokenSHA256: hex.EncodeToString(sum[:]),
+	}
+}
+
+// appendAuditLog appends the given record as a JSON line to filename. If the
+// line would make the file larger than maxSize bytes, the file is rotated
+// first, see rotateAuditLog. A maxSize of 0 disables the rotation.
+func appendAuditLog(filename string, r *auditRecord, maxSize int64, maxFiles int) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling audit record")
+	}
+	if maxSize > 0 {
+		st, err := os.Stat(filename)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return errs.FileError(err, filename)
+		case st.Size() > 0 && st.Size()+int64(len(b))+1 > maxSize:
+			if err := rotateAuditLog(filename, maxFiles); err != nil {
+				return err
+			}
+		}
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return errs.FileError(err, filename)
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return errs.FileError(err, filename)
+	}
+	if err := f.Close(); err != nil {
+		return errs.FileError(err, filename)
+	}
+	return nil
+}
+
+// rotateAuditLog renames filename to filename.1, after renaming each previous
+// file filename.N to filename.N+1. Only maxFiles rotated files are kept, the
+// oldest one is removed, and with 0 the file is just removed.
+func rotateAuditLog(filename string, maxFiles int) error {
+	rotated := func(n int) string {
+		return fmt.Sprintf("%s.%d", filename, n)
+	}
+	if maxFiles <= 0 {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return errs.FileError(err, filename)
+		}
+		return nil
+	}
+	if err := os.Remove(rotated(maxFiles)); err != nil && !os.IsNotExist(err) {
+		return errs.FileError(err, rotated(maxFiles))
+	}
+	for n := maxFiles - 1; n > 0; n-- {
+		if err := os.Rename(rotated(n), rotated(n+1)); err != nil && !os.IsNotExist(err) {
+			return errs.FileError(err, rotated(n))
+		}
+	}
+	if err := os.Rename(filename, rotated(1)); err != nil {
+		return errs.FileError(err, filename)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package oauth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+)
+
+func TestAppendAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-oauth")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	issuedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	filename := filepath.Join(dir, "audit.log")
+	assert.FatalError(t, appendAuditLog(filename, newAuditRecord("google", flowLoopback, "openid email", &token{AccessToken: "the-access-token"}, issuedAt), defaultAuditLogMaxSize, defaultAuditLogMaxFiles))
+	assert.FatalError(t, appendAuditLog(filename, newAuditRecord("", flowTwoLegged, "openid", &token{AccessToken: "the-access-token", Scope: "read"}, issuedAt), defaultAuditLogMaxSize, defaultAuditLogMaxFiles))
+
+	b, err := ioutil.ReadFile(filename)
+	assert.FatalError(t, err)
+	sum := "b9bcbd67c19bfc7ff1e1f3e3c0dce0bbbf786fceb489fc0fb1bc2795f362085b"
+	assert.Equals(t, `{"timestamp":"2020-01-02T03:04:05Z","provider":"google","flow":"loopback","scope":"openid email","token_sha256":"`+sum+`"}
+{"timestamp":"2020-01-02T03:04:05Z","flow":"2lo","scope":"read","token_sha256":"`+sum+`"}
+`, string(b))
+}
+
+func TestAppendAuditLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-oauth")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "audit.log")
+	// All the records have the same size.
+	issuedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	record := func(provider string) *auditRecord {
+		return newAuditRecord(provider, flowLoopback, "openid", &token{AccessToken: "the-access-token"}, issuedAt)
+	}
+	read := func(name string) string {
+		t.Helper()
+		b, err := ioutil.ReadFile(name)
+		assert.FatalError(t, err)
+		return string(b)
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}
+
+	// Each file fits two records.
+	assert.FatalError(t, appendAuditLog(filename, record("p1"), 0, 0))
+	maxSize := 2 * int64(len(read(filename)))
+	assert.FatalError(t, os.Remove(filename))
+
+	for _, p := range []string{"p1", "p2", "p3", "p4", "p5", "p6", "p7"} {
+		assert.FatalError(t, appendAuditLog(filename, record(p), maxSize, 2))
+	}
+	assert.True(t, strings.Contains(read(filename), `"provider":"p7"`))
+	assert.True(t, strings.Contains(read(filename+".1"), `"provider":"p5"`))
+	assert.True(t, strings.Contains(read(filename+".1"), `"provider":"p6"`))
+	assert.True(t, strings.Contains(read(filename+".2"), `"provider":"p3"`))
+	assert.True(t, strings.Contains(read(filename+".2"), `"provider":"p4"`))
+	assert.False(t, exists(filename+".3"))
+
+	// Without rotated files the log starts over.
+	assert.FatalError(t, appendAuditLog(filename, record("p8"), maxSize, 0))
+	assert.FatalError(t, appendAuditLog(filename, record("p9"), maxSize, 0))
+	assert.Equals(t, 1, strings.Count(read(filename), "\n"))
+	assert.True(t, strings.Contains(read(filename), `"provider":"p9"`))
+
+	// A size of 0 disables the rotation.
+	for i := 0; i < 5; i++ {
+		assert.FatalError(t, appendAuditLog(filename, record("p0"), 0, 2))
+	}
+	assert.Equals(t, 6, strings.Count(read(filename), "\n"))
+}
@@ -0,0 +1,272 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/cli/config"
+	"github.com/smallstep/cli/errs"
+	"golang.org/x/term"
+)
+
+// isInteractive returns true if the standard input is a terminal, it is
+// replaced in the tests.
+var isInteractive = func() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// cacheExpiryLeeway is the time before the expiration from which a cached
+// token is no longer used, so it does not expire right after being printed.
+const cacheExpiryLeeway = time.Minute
+
+// cacheLockPoll is the interval between the checks of a lock held by another
+// step oauth, it is replaced in the tests.
+var cacheLockPoll = 500 * time.Millisecond
+
+// The values of --cache-primary, the token whose expiration decides if a
+// cached token can be used.
+const (
+	cachePrimaryAccess = "access"
+	cachePrimaryID     = "id"
+)
+
+// cacheKey are the values that identify a token in the cache. They are also
+// stored in the file, so the entries can be listed.
+type cacheKey struct {
+	Provider      string `json:"provider,omitempty"`
+	TokenEndpoint string `json:"token_endpoint,omitempty"`
+	ClientID      string `json:"client_id,omitempty"`
+	Scope         string `json:"scope,omitempty"`
+}
+
+// cachedToken is the content of a file in the token cache.
+type cachedToken struct {
+	cacheKey
+	Token     *token    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// expiresAt returns the expiration of the primary token, the access token or
+// the ID token. It returns the zero time if the expiration is not known.
+func (ct *cachedToken) expiresAt(primary string) time.Time {
+	if primary == cachePrimaryID {
+		return idTokenExpiry(ct.Token.IDToken)
+	}
+	return ct.ExpiresAt
+}
+
+// valid returns true if the primary token in the cache can be used at the
+// given time. Tokens without expiration are never used, but they can be
+// refreshed.
+func (ct *cachedToken) valid(now time.Time, primary string) bool {
+	s := ct.Token.AccessToken
+	if primary == cachePrimaryID {
+		s = ct.Token.IDToken
+	}
+	expiresAt := ct.expiresAt(primary)
+	return s != "" && !expiresAt.IsZero() && now.Add(cacheExpiryLeeway).Before(expiresAt)
+}
+
+// cacheDir returns the directory of the token cache, it is replaced in the
+// tests.
+var cacheDir = func() string {
+	return filepath.Join(config.StepPath(), "cache", "oauth")
+}
+
+// cacheFilename returns the file in the token cache for the given provider,
+// token endpoint, client id, and scope. The name is a hash of the values so it
+// does not leak them.
+func cacheFilename(provider, tokenEndpoint, clientID, scope string) string {
+	sum := sha256.Sum256([]byte(provider + "\n" + tokenEndpoint + "\n" + clientID + "\n" + scope))
+	return filepath.Join(cacheDir(), hex.EncodeToString(sum[:])+".json")
+}
+
+// readCache reads a cached token. It returns nil if the file does not exist.
+func readCache(filename string) (*cachedToken, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errs.FileError(err, filename)
+	}
+	var ct cachedToken
+	if err := json.Unmarshal(b, &ct); err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", filename)
+	}
+	if ct.Token == nil {
+		return nil, errors.Errorf("error reading %s: missing token", filename)
+	}
+	return &ct, nil
+}
+
+// writeCache writes the token issued at the given time to the cache. The
+// cache directory is created with 0700 permissions, and the file with 0600.
+func writeCache(filename string, key cacheKey, tok *token, issuedAt time.Time) error {
+	ct := &cachedToken{cacheKey: key, Token: tok}
+	if tok.ExpiresIn > 0 {
+		ct.ExpiresAt = issuedAt.Add(time.Duration(tok.ExpiresIn) * time.Second).UTC()
+	}
+	b, err := json.Marshal(ct)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling cached token")
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return errs.FileError(err, filepath.Dir(filename))
+	}
+	return writeFileAtomic(filename, b)
+}
+
+// listCache returns the tokens in the given cache directory, sorted by
+// provider, client id, and scope. Files that cannot be read are skipped with a
+// warning.
+func listCache(dir string) ([]*cachedToken, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var entries []*cachedToken
+	for _, filename := range files {
+		ct, err := readCache(filename)
+		if err != nil {
+			warnf("%v", err)
+			continue
+		}
+		if ct != nil {
+			entries = append(entries, ct)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i].cacheKey, entries[j].cacheKey
+		if a.Provider != b.Provider {
+			return a.Provider < b.Provider
+		}
+		if a.ClientID != b.ClientID {
+			return a.ClientID < b.ClientID
+		}
+		return a.Scope < b.Scope
+	})
+	return entries, nil
+}
+
+// printCacheList writes a table with the key, the expiration, and the state
+// of the given cached tokens.
+func printCacheList(w io.Writer, entries []*cachedToken, now time.Time) error {
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	tw := new(tabwriter.Writer)
+	// Format in tab-separated columns with a tab stop of 8.
+	tw.Init(w, 0, 8, 1, '\t', 0)
+	fmt.Fprintln(tw, "PROVIDER\tCLIENT ID\tSCOPE\tEXPIRES AT\tSTATE")
+	for _, ct := range entries {
+		expiresAt, state := "-", "valid"
+		if !ct.ExpiresAt.IsZero() {
+			expiresAt = ct.ExpiresAt.Format(time.RFC3339)
+		}
+		if !ct.valid(now, cachePrimaryAccess) {
+			state = "expired"
+			if ct.Token.RefreshToken != "" {
+				state = "expired (refreshable)"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", orDash(ct.Provider), orDash(ct.ClientID), orDash(ct.Scope), expiresAt, state)
+	}
+	return tw.Flush()
+}
+
+// lockCache creates a lock file next to the given cache file, so a second step
+// oauth with the same provider, client id and scope waits for the
+// authorization of the first one instead of opening another browser. A lock
+// older than stale is taken over, as the process holding it has exited or is
+// not going to complete. The second value is true if the lock was held by
+// another process, and the cache must be read again. The returned function
+// removes the lock.
+func lockCache(filename string, stale time.Duration) (func(), bool, error) {
+	lock := filename + ".lock"
+	if err := os.MkdirAll(filepath.Dir(lock), 0700); err != nil {
+		return nil, false, errs.FileError(err, filepath.Dir(lock))
+	}
+	var waited bool
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			fmt.Fprintln(f, os.Getpid())
+			f.Close()
+			return func() { os.Remove(lock) }, waited, nil
+		}
+		if !os.IsExist(err) {
+			return nil, false, errs.FileError(err, lock)
+		}
+		st, err := os.Stat(lock)
+		switch {
+		case os.IsNotExist(err):
+			// Released after the first attempt.
+			continue
+		case err != nil:
+			return nil, false, errs.FileError(err, lock)
+		case time.Since(st.ModTime()) > stale:
+			if err := os.Remove(lock); err != nil && !os.IsNotExist(err) {
+				return nil, false, errs.FileError(err, lock)
+			}
+			continue
+		}
+		if !waited {
+			warnf("waiting for another step oauth to complete the authorization; remove %s to stop waiting", lock)
+			waited = true
+		}
+		time.Sleep(cacheLockPoll)
+	}
+}
+
+// clearCache removes the given cache directory and all the tokens in it.
+func clearCache(dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return errs.FileError(err, dir)
+	}
+	return nil
+}
+
+// fromCache returns the token in the given cache file if its primary token,
+// the access token or the ID token, has not expired, or a new token if it has
+// expired and it has a refresh token. The expires_in of a cached token is the
+// remaining lifetime of the primary token. The second value is true if the
+// token was refreshed. It returns nil if the token cannot be used, and a full
+// flow is required, and an error if the refresh of the cached token fails.
+func (o *oauth) fromCache(filename, primary string, now time.Time) (*token, bool, error) {
+	ct, err := readCache(filename)
+	if err != nil {
+		warnf("%v", err)
+		return nil, false, nil
+	}
+	switch {
+	case ct == nil:
+		return nil, false, nil
+	case ct.valid(now, primary):
+		// Use a copy with the remaining lifetime.
+		tok := *ct.Token
+		tok.ExpiresIn = int(ct.expiresAt(primary).Sub(now).Seconds())
+		return &tok, false, nil
+	case ct.Token.RefreshToken != "":
+		tok, err := o.DoRefreshToken(ct.Token.RefreshToken, "")
+		if err != nil {
+			return nil, false, errors.Wrap(err, "error refreshing the cached token")
+		}
+		return tok, true, nil
+	default:
+		return nil, false, nil
+	}
+}
@@ -0,0 +1,232 @@
+package oauth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+)
+
+func TestCacheFilename(t *testing.T) {
+	a := cacheFilename("https://example.org", "https://example.org/token", "client-id", "openid email")
+	b := cacheFilename("https://example.org", "https://example.org/token", "client-id", "openid")
+	assert.NotEquals(t, a, b)
+	assert.Equals(t, cacheDir(), filepath.Dir(a))
+	assert.Equals(t, a, cacheFilename("https://example.org", "https://example.org/token", "client-id", "openid email"))
+}
+
+func TestClearCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-oauth")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache := filepath.Join(dir, "cache")
+	filename := filepath.Join(cache, "token.json")
+	assert.FatalError(t, writeCache(filename, cacheKey{}, &token{AccessToken: "the-access-token", ExpiresIn: 3600}, time.Now()))
+	assert.FatalError(t, clearCache(cache))
+	_, err = os.Stat(filename)
+	assert.True(t, os.IsNotExist(err))
+
+	// A missing cache is not an error.
+	assert.FatalError(t, clearCache(cache))
+}
+
+func TestListCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-oauth")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A missing cache is an empty list.
+	entries, err := listCache(filepath.Join(dir, "missing"))
+	assert.FatalError(t, err)
+	assert.Len(t, 0, entries)
+
+	now := time.Now()
+	google := cacheKey{Provider: "google", TokenEndpoint: "https://example.org/token", ClientID: "client-id", Scope: "openid email"}
+	github := cacheKey{Provider: "github", TokenEndpoint: "https://example.org/token", ClientID: "client-id", Scope: "user"}
+	okta := cacheKey{Provider: "okta", TokenEndpoint: "https://example.org/token", ClientID: "other-id", Scope: "openid"}
+	assert.FatalError(t, writeCache(filepath.Join(dir, "a.json"), google, &token{AccessToken: "the-access-token", ExpiresIn: 3600}, now))
+	assert.FatalError(t, writeCache(filepath.Join(dir, "b.json"), github, &token{AccessToken: "the-access-token", ExpiresIn: 60}, now.Add(-time.Hour)))
+	assert.FatalError(t, writeCache(filepath.Join(dir, "c.json"), okta, &token{AccessToken: "the-access-token", RefreshToken: "the-refresh-token", ExpiresIn: 60}, now.Add(-time.Hour)))
+	assert.FatalError(t, ioutil.WriteFile(filepath.Join(dir, "d.json"), []byte("not json"), 0600))
+
+	entries, err = listCache(dir)
+	assert.FatalError(t, err)
+	assert.Len(t, 3, entries)
+	assert.Equals(t, github, entries[0].cacheKey)
+	assert.Equals(t, google, entries[1].cacheKey)
+	assert.Equals(t, okta, entries[2].cacheKey)
+
+	var buf bytes.Buffer
+	assert.FatalError(t, printCacheList(&buf, entries, now))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, 4, lines)
+	assert.Equals(t, []string{"PROVIDER", "CLIENT", "ID", "SCOPE", "EXPIRES", "AT", "STATE"}, strings.Fields(lines[0]))
+	assert.Equals(t, []string{"github", "client-id", "user", now.Add(-59 * time.Minute).Format(time.RFC3339), "expired"}, strings.Fields(lines[1]))
+	assert.Equals(t, []string{"google", "client-id", "openid", "email", now.Add(time.Hour).Format(time.RFC3339), "valid"}, strings.Fields(lines[2]))
+	assert.Equals(t, []string{"okta", "other-id", "openid", now.Add(-59 * time.Minute).Format(time.RFC3339), "expired", "(refreshable)"}, strings.Fields(lines[3]))
+}
+
+func TestLockCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-oauth")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	poll := cacheLockPoll
+	cacheLockPoll = 10 * time.Millisecond
+	defer func() { cacheLockPoll = poll }()
+
+	filename := filepath.Join(dir, "cache", "token.json")
+	unlock, waited, err := lockCache(filename, time.Minute)
+	assert.FatalError(t, err)
+	assert.False(t, waited)
+
+	// A second lock waits for the first one.
+	type result struct {
+		unlock func()
+		waited bool
+		err    error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		unlock, waited, err := lockCache(filename, time.Minute)
+		ch <- result{unlock, waited, err}
+	}()
+	select {
+	case <-ch:
+		t.Fatal("lockCache did not wait for the lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	r := <-ch
+	assert.FatalError(t, r.err)
+	assert.True(t, r.waited)
+	r.unlock()
+	_, err = os.Stat(filename + ".lock")
+	assert.True(t, os.IsNotExist(err))
+
+	// A stale lock is taken over.
+	assert.FatalError(t, ioutil.WriteFile(filename+".lock", []byte("1\n"), 0600))
+	old := time.Now().Add(-time.Hour)
+	assert.FatalError(t, os.Chtimes(filename+".lock", old, old))
+	unlock, waited, err = lockCache(filename, time.Minute)
+	assert.FatalError(t, err)
+	assert.False(t, waited)
+	unlock()
+}
+
+func TestFromCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-oauth")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	var refreshToken string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		refreshToken = r.PostForm.Get("refresh_token")
+		w.Header().Set("Content-Type", "application/json")
+		if refreshToken == "a-revoked-token" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"the-new-access-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer srv.Close()
+
+	o := &oauth{clientID: "client-id", tokenEndpoint: srv.URL}
+	filename := filepath.Join(dir, "cache", "token.json")
+	now := time.Now()
+
+	// Missing file.
+	tok, refreshed, err := o.fromCache(filename, cachePrimaryAccess, now)
+	assert.FatalError(t, err)
+	assert.Nil(t, tok)
+	assert.False(t, refreshed)
+
+	// Valid token.
+	assert.FatalError(t, writeCache(filename, cacheKey{}, &token{AccessToken: "the-access-token", RefreshToken: "the-refresh-token", ExpiresIn: 3600}, now))
+	if runtime.GOOS != "windows" {
+		st, err := os.Stat(filename)
+		assert.FatalError(t, err)
+		assert.Equals(t, os.FileMode(0600), st.Mode().Perm())
+	}
+	tok, refreshed, err = o.fromCache(filename, cachePrimaryAccess, now.Add(10*time.Minute))
+	assert.FatalError(t, err)
+	assert.False(t, refreshed)
+	assert.Equals(t, "the-access-token", tok.AccessToken)
+	assert.Equals(t, 3000, tok.ExpiresIn)
+
+	// Expired token with refresh token.
+	tok, refreshed, err = o.fromCache(filename, cachePrimaryAccess, now.Add(3570*time.Second))
+	assert.FatalError(t, err)
+	assert.True(t, refreshed)
+	assert.Equals(t, "the-new-access-token", tok.AccessToken)
+	assert.Equals(t, "the-refresh-token", tok.RefreshToken)
+	assert.Equals(t, "the-refresh-token", refreshToken)
+
+	// The refresh fails.
+	assert.FatalError(t, writeCache(filename, cacheKey{}, &token{AccessToken: "the-access-token", RefreshToken: "a-revoked-token", ExpiresIn: 3600}, now))
+	tok, _, err = o.fromCache(filename, cachePrimaryAccess, now.Add(2*time.Hour))
+	assert.Error(t, err)
+	assert.Nil(t, tok)
+
+	// Expired token without refresh token.
+	assert.FatalError(t, writeCache(filename, cacheKey{}, &token{AccessToken: "the-access-token", ExpiresIn: 3600}, now))
+	tok, _, err = o.fromCache(filename, cachePrimaryAccess, now.Add(2*time.Hour))
+	assert.FatalError(t, err)
+	assert.Nil(t, tok)
+
+	// Tokens without expiration are not used.
+	assert.FatalError(t, writeCache(filename, cacheKey{}, &token{AccessToken: "the-access-token"}, now))
+	tok, _, err = o.fromCache(filename, cachePrimaryAccess, now)
+	assert.FatalError(t, err)
+	assert.Nil(t, tok)
+
+	// The ID token is the primary token. The exp claim has a precision of
+	// seconds.
+	now = now.Truncate(time.Second)
+	enc := base64.RawURLEncoding.EncodeToString
+	idToken := func(exp time.Time) string {
+		return enc([]byte(`{"alg":"RS256"}`)) + "." + enc([]byte(fmt.Sprintf(`{"sub":"1234","exp":%d}`, exp.Unix()))) + ".c2lnbmF0dXJl"
+	}
+	assert.FatalError(t, writeCache(filename, cacheKey{}, &token{AccessToken: "the-access-token", IDToken: idToken(now.Add(2 * time.Hour)), ExpiresIn: 3600}, now))
+	tok, refreshed, err = o.fromCache(filename, cachePrimaryID, now.Add(90*time.Minute))
+	assert.FatalError(t, err)
+	assert.False(t, refreshed)
+	assert.Equals(t, "the-access-token", tok.AccessToken)
+	assert.Equals(t, 1800, tok.ExpiresIn)
+	tok, _, err = o.fromCache(filename, cachePrimaryAccess, now.Add(90*time.Minute))
+	assert.FatalError(t, err)
+	assert.Nil(t, tok)
+
+	// An expired ID token is not used even if the access token is valid.
+	assert.FatalError(t, writeCache(filename, cacheKey{}, &token{AccessToken: "the-access-token", IDToken: idToken(now.Add(10 * time.Minute)), ExpiresIn: 3600}, now))
+	tok, _, err = o.fromCache(filename, cachePrimaryID, now.Add(30*time.Minute))
+	assert.FatalError(t, err)
+	assert.Nil(t, tok)
+	tok, _, err = o.fromCache(filename, cachePrimaryAccess, now.Add(30*time.Minute))
+	assert.FatalError(t, err)
+	assert.Equals(t, 1800, tok.ExpiresIn)
+
+	// Without ID token.
+	assert.FatalError(t, writeCache(filename, cacheKey{}, &token{AccessToken: "the-access-token", ExpiresIn: 3600}, now))
+	tok, _, err = o.fromCache(filename, cachePrimaryID, now)
+	assert.FatalError(t, err)
+	assert.Nil(t, tok)
+
+	// Invalid file.
+	assert.FatalError(t, ioutil.WriteFile(filename, []byte("{}"), 0600))
+	_, err = readCache(filename)
+	assert.Error(t, err)
+}
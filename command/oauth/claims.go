@@ -0,0 +1,85 @@
+package oauth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// decodedJWT is the decoded header and payload of a JWT.
+type decodedJWT struct {
+	Header  json.RawMessage `json:"header"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// decodeJWT decodes the header and payload of the given JWT without
+// verifying its signature.
+func decodeJWT(s string) (*decodedJWT, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("error decoding token: JWT must have three parts")
+	}
+	var dec decodedJWT
+	for i, v := range []*json.RawMessage{&dec.Header, &dec.Payload} {
+		b, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			return nil, errors.Wrap(err, "error decoding token")
+		}
+		if !json.Valid(b) {
+			return nil, errors.New("error decoding token: invalid JSON")
+		}
+		*v = b
+	}
+	return &dec, nil
+}
+
+// idTokenExpiry returns the exp claim of the given ID token. It returns the
+// zero time if the token cannot be decoded or it does not have the claim.
+func idTokenExpiry(idToken string) time.Time {
+	if idToken == "" {
+		return time.Time{}
+	}
+	dec, err := decodeJWT(idToken)
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(dec.Payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
+
+// idTokenWithClaims is the output of --with-claims.
+type idTokenWithClaims struct {
+	IDToken string          `json:"id_token"`
+	Claims  json.RawMessage `json:"claims"`
+}
+
+// identity returns the value of the given claim in the ID token, or the value
+// of the sub claim if it is not present. It returns an empty string if the
+// token cannot be decoded or does not have any of them.
+func identity(idToken, claim string) string {
+	if idToken == "" {
+		return ""
+	}
+	dec, err := decodeJWT(idToken)
+	if err != nil {
+		return ""
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(dec.Payload, &claims); err != nil {
+		return ""
+	}
+	for _, name := range []string{claim, "sub"} {
+		if v, ok := claims[name].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
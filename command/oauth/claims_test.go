@@ -0,0 +1,75 @@
+package oauth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+)
+
+func TestDecodeJWT(t *testing.T) {
+	enc := base64.RawURLEncoding.EncodeToString
+	header := `{"alg":"RS256","kid":"the-kid","typ":"JWT"}`
+	payload := `{"iss":"https://example.org","sub":"1234"}`
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"ok", enc([]byte(header)) + "." + enc([]byte(payload)) + ".c2lnbmF0dXJl", false},
+		{"fail parts", enc([]byte(header)) + "." + enc([]byte(payload)), true},
+		{"fail opaque", "ya29.a0AfH6SMBx", true},
+		{"fail base64", "!!." + enc([]byte(payload)) + ".c2lnbmF0dXJl", true},
+		{"fail json", enc([]byte(header)) + "." + enc([]byte("not-json")) + ".c2lnbmF0dXJl", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dec, err := decodeJWT(tt.token)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.FatalError(t, err)
+			assert.Equals(t, header, string(dec.Header))
+			assert.Equals(t, payload, string(dec.Payload))
+		})
+	}
+}
+
+func TestIDTokenWithClaims(t *testing.T) {
+	enc := base64.RawURLEncoding.EncodeToString
+	idToken := enc([]byte(`{"alg":"RS256"}`)) + "." + enc([]byte(`{"sub":"1234"}`)) + ".c2lnbmF0dXJl"
+	dec, err := decodeJWT(idToken)
+	assert.FatalError(t, err)
+	b, err := json.Marshal(&idTokenWithClaims{IDToken: idToken, Claims: dec.Payload})
+	assert.FatalError(t, err)
+	assert.Equals(t, `{"id_token":"`+idToken+`","claims":{"sub":"1234"}}`, string(b))
+}
+
+func TestIDTokenExpiry(t *testing.T) {
+	enc := base64.RawURLEncoding.EncodeToString
+	header := enc([]byte(`{"alg":"RS256"}`))
+	idToken := header + "." + enc([]byte(`{"sub":"1234","exp":1600000000}`)) + ".c2lnbmF0dXJl"
+	noExp := header + "." + enc([]byte(`{"sub":"1234"}`)) + ".c2lnbmF0dXJl"
+
+	assert.Equals(t, time.Unix(1600000000, 0), idTokenExpiry(idToken))
+	assert.True(t, idTokenExpiry(noExp).IsZero())
+	assert.True(t, idTokenExpiry("").IsZero())
+	assert.True(t, idTokenExpiry("ya29.a0AfH6SMBx").IsZero())
+}
+
+func TestIdentity(t *testing.T) {
+	enc := base64.RawURLEncoding.EncodeToString
+	header := enc([]byte(`{"alg":"RS256"}`))
+	idToken := header + "." + enc([]byte(`{"sub":"1234","email":"alice@example.com","upn":"alice@corp"}`)) + ".c2lnbmF0dXJl"
+	noEmail := header + "." + enc([]byte(`{"sub":"1234"}`)) + ".c2lnbmF0dXJl"
+
+	assert.Equals(t, "alice@example.com", identity(idToken, "email"))
+	assert.Equals(t, "alice@corp", identity(idToken, "upn"))
+	assert.Equals(t, "1234", identity(noEmail, "email"))
+	assert.Equals(t, "", identity("", "email"))
+	assert.Equals(t, "", identity("ya29.a0AfH6SMBx", "email"))
+}
@@ -1,6 +1,8 @@
 package oauth
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
@@ -8,18 +10,22 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/cli/command"
+	"github.com/smallstep/cli/config"
 	"github.com/smallstep/cli/crypto/randutil"
 	"github.com/smallstep/cli/errs"
 	"github.com/smallstep/cli/exec"
@@ -49,6 +55,68 @@ const (
 	oobCallbackUrn = "urn:ietf:wg:oauth:2.0:oob"
 	// The URN for token request grant type jwt-bearer
 	jwtBearerUrn = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	// The URN for token request grant type token-exchange
+	tokenExchangeUrn = "urn:ietf:params:oauth:grant-type:token-exchange"
+	// The URN for token request grant type device_code
+	deviceCodeUrn = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// defaultReadyTimeout is the default time to wait for the callback server to
+// accept connections before opening the browser.
+const defaultReadyTimeout = 5 * time.Second
+
+// defaultBrowserTimeout is the default time to wait for the browser to send
+// the authorization code to the callback url.
+const defaultBrowserTimeout = 2 * time.Minute
+
+// defaultExchangeTimeout is the default time to wait for the token exchange
+// once the authorization code has been received.
+const defaultExchangeTimeout = time.Minute
+
+// Default timeouts of the callback server. Slow or idle connections, like the
+// ones opened by browser prefetchers, are closed so they cannot keep the
+// server running. The write timeout includes the token exchange.
+const (
+	defaultServerReadTimeout  = 10 * time.Second
+	defaultServerWriteTimeout = 2 * time.Minute
+	defaultServerIdleTimeout  = 5 * time.Second
+)
+
+// defaultDiscoveryAccept is the default Accept header of the discovery
+// request.
+const defaultDiscoveryAccept = "application/json"
+
+// Client authentication methods in the token request of a service account, as
+// defined in OpenID Connect Core 1.0, section 9.
+const (
+	tokenAuthNone  = "none"
+	tokenAuthPost  = "client_secret_post"
+	tokenAuthBasic = "client_secret_basic"
+)
+
+// maxAuthURLLength is the length of the authorization url from which some
+// servers and browsers start to fail with errors like 414 URI Too Long.
+const maxAuthURLLength = 2048
+
+// Names of the flows used to retrieve a token.
+const (
+	flowLoopback  = "loopback"
+	flowConsole   = "console"
+	flowDevice    = "device"
+	flowTwoLegged = "2lo"
+	flowJWT       = "jwt"
+
+	flowClientCredentials = "client-credentials"
+
+	// The token was read from the cache, or refreshed using the cached
+	// refresh token.
+	flowCache        = "cache"
+	flowCacheRefresh = "cache-refresh"
+
+	flowTokenExchange = "token-exchange"
+	flowExchangeCode  = "exchange-code"
+	flowRefreshToken  = "refresh-token"
+	flowSelfSigned    = "self-signed"
 )
 
 type token struct {
@@ -57,8 +125,12 @@ type token struct {
 	RefreshToken string `json:"refresh_token"`
 	ExpiresIn    int    `json:"expires_in"`
 	TokenType    string `json:"token_type"`
+	Scope        string `json:"scope,omitempty"`
 	Err          string `json:"error,omitempty"`
 	ErrDesc      string `json:"error_description,omitempty"`
+
+	// IssuedTokenType is only returned in token exchange responses.
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
 }
 
 func init() {
@@ -80,8 +152,33 @@ func init() {
 [**--token-endpoint**=<token-endpoint>]
 [**--scope**=<scope> ...] [**--bare** [**--oidc**]] [**--header** [**--oidc**]] [**--prompt**=<prompt>]
 
-**step oauth** **--account**=<account> **--jwt**
-[**--scope**=<scope> ...] [**--header**] [**-bare**] [**--prompt**=<prompt>]`,
+**step oauth** **--device** [**--provider**=<provider>]
+[**--client-id**=<client-id> **--client-secret**=<client-secret>]
+[**--scope**=<scope> ...] [**--bare** [**--oidc**]] [**--header** [**--oidc**]]
+
+**step oauth** **--client-credentials** **--client-id**=<client-id> **--client-secret**=<client-secret>
+[**--provider**=<provider>] [**--token-endpoint**=<token-endpoint>]
+[**--scope**=<scope> ...] [**--token-auth-method**=<method>] [**--bare**] [**--header**]
+
+**step oauth** **--account**=<account> **--jwt** [**--jwt-audience**=<audience>]
+[**--scope**=<scope> ...] [**--header**] [**-bare**] [**--prompt**=<prompt>]
+
+**step oauth** **--self-signed** **--signing-key**=<file> [**--claim**=<name=value> ...]
+[**--bare** [**--oidc**]] [**--header** [**--oidc**]]
+
+**step oauth** **--exchange-code**=<code> [**--code-verifier**=<verifier>]
+[**--listen-url**=<url>] [**--provider**=<provider>] [**--token-endpoint**=<token-endpoint>]
+[**--client-id**=<client-id> **--client-secret**=<client-secret>] [**--bare**] [**--header**]
+
+**step oauth** **--refresh-token**=<token> [**--scope**=<scope> ...]
+[**--provider**=<provider>] [**--token-endpoint**=<token-endpoint>]
+[**--client-id**=<client-id> **--client-secret**=<client-secret>] [**--bare** [**--oidc**]] [**--header** [**--oidc**]]
+
+**step oauth** **--token-exchange** **--subject-token**=<token>
+[**--subject-token-type**=<type>] [**--actor-token**=<token> [**--actor-token-type**=<type>]]
+[**--audience**=<audience> ...] [**--scope**=<scope> ...]
+[**--provider**=<provider>] [**--token-endpoint**=<token-endpoint>]
+[**--client-id**=<client-id> **--client-secret**=<client-secret>] [**--bare**] [**--header**]`,
 		Description: `**step oauth** command implements the OAuth 2.0 authorization flow.
 
 OAuth is an open standard for access delegation, commonly used as a way for
@@ -99,6 +196,22 @@ endpoint. If Google is used this flag is not necessary, but the appropriate
 value would be be https://accounts.google.com or
 https://accounts.google.com/.well-known/openid-configuration
 
+## EXIT CODES
+
+This command returns '0' on success and '1' on any error. If **--exit-status**
+is set, a successful run returns '0' if the token was obtained with a new
+authorization, '10' if it was read from the cache, and '11' if it was obtained
+with a refresh token, from the cache or from **--refresh-token**. These codes
+are a stable interface for scripts.
+
+If the silent authentication requested with **--prompt**=none fails because the
+user has to interact with the provider, the command returns '12', so the flow
+can be retried without it.
+
+If **--no-reauth** is set and the provider rejects the refresh token of a cached
+token with invalid_grant, the command returns '13' instead of starting a new
+authorization.
+
 ## EXAMPLES
 
 Do the OAuth 2.0 flow using the default client:
@@ -106,9 +219,14 @@ Do the OAuth 2.0 flow using the default client:
 $ step oauth
 '''
 
+Authorize from a different device, useful on servers without a browser:
+'''
+$ step oauth --device --provider https://example.org --client-id my-client-id
+'''
+
 Redirect to localhost instead of 127.0.0.1:
 '''
-$ step oauth --listen localhost:0
+$ step oauth --loopback-redirect-host localhost
 '''
 
 Redirect to a fixed port instead of random one:
@@ -121,6 +239,12 @@ Redirect to a fixed url but listen on all the interfaces:
 $ step oauth --listen 0.0.0.0:10000 --listen-url http://127.0.0.1:10000
 '''
 
+Use a registered redirect_uri served by a reverse proxy that forwards the
+requests to a local port:
+'''
+$ step oauth --listen :10000 --listen-url https://proxy.example.com/oauth/callback
+'''
+
 Get just the access token:
 '''
 $ step oauth --bare
@@ -135,6 +259,81 @@ Use a custom OAuth2.0 server:
 '''
 $ step oauth --client-id my-client-id --client-secret my-client-secret \
   --provider https://example.org
+'''
+
+Print the resolved endpoints and settings without running the flow:
+'''
+$ step oauth --client-id my-client-id --client-secret my-client-secret \
+  --provider https://example.org --print-config
+'''
+
+Use step oauth as a git credential helper:
+'''
+$ git config --global credential.https://git.example.com.helper \
+  "!step oauth --provider https://example.org --client-id my-client-id --git-credential"
+'''
+
+List the scopes supported by a provider:
+'''
+$ step oauth --provider https://example.org --list-scopes
+'''
+
+Keep the callback server running on a fixed port and get a new token every time
+http://127.0.0.1:10000/authorize is visited:
+'''
+$ step oauth --listen :10000 --serve
+'''
+
+Get a token for a service account whose key is read from STDIN:
+'''
+$ cat service-account.json | step oauth --account - --bare
+'''
+
+Generate an ID token for local testing signed with a local key:
+'''
+$ step oauth --self-signed --signing-key key.pem \
+  --claim aud=my-service --claim email=jane@example.com --claim email_verified=true \
+  --oidc --bare
+'''
+
+Get a token for a confidential client using the client credentials grant:
+'''
+$ step oauth --client-credentials --provider https://example.org \
+  --client-id my-client-id --client-secret my-client-secret --scope read --scope write --bare
+'''
+
+Exchange an authorization code obtained in a different step:
+'''
+$ step oauth --exchange-code $CODE --code-verifier $VERIFIER \
+  --listen-url http://127.0.0.1:10000 --provider https://example.org \
+  --client-id my-client-id --client-secret my-client-secret
+'''
+
+Get a new access token using the refresh token of a previous authorization:
+'''
+$ step oauth --refresh-token $REFRESH_TOKEN --provider https://example.org \
+  --client-id my-client-id --client-secret my-client-secret --bare
+'''
+
+Write the ID token for AWS IAM OIDC federation:
+'''
+$ step oauth --provider https://example.org --client-id my-client-id \
+  --client-secret my-client-secret --web-identity-token-file ~/.aws/web-identity-token --quiet
+$ AWS_WEB_IDENTITY_TOKEN_FILE=~/.aws/web-identity-token AWS_ROLE_ARN=arn:aws:iam::123456789012:role/my-role \
+  aws sts get-caller-identity
+'''
+
+Reuse the token in the next runs until it expires:
+'''
+$ step oauth --provider https://example.org --client-id my-client-id \
+  --client-secret my-client-secret --cache --bare
+'''
+
+Exchange an access token for a token to be used in another service:
+'''
+$ step oauth --token-exchange --subject-token $TOKEN \
+  --audience https://api.example.com --token-endpoint https://example.org/token \
+  --client-id my-client-id --client-secret my-client-secret
 '''`,
 		Flags: []cli.Flag{
 			cli.StringFlag{
@@ -150,6 +349,31 @@ $ step oauth --client-id my-client-id --client-secret my-client-secret \
 				Name:  "console, c",
 				Usage: "Complete the flow while remaining only inside the terminal",
 			},
+			cli.BoolFlag{
+				Name: "client-credentials",
+				Usage: `Get a token for the client itself using the client_credentials grant, without
+a user or a browser. It requires a confidential client with **--client-id** and
+**--client-secret**. The scopes are only sent if **--scope** is set.`,
+			},
+			cli.BoolFlag{
+				Name: "device",
+				Usage: `Use the device authorization grant defined in RFC 8628. The verification url
+and a code to enter are printed, and the authorization can be completed in a
+browser in any other device. The provider must support the grant.`,
+			},
+			cli.BoolFlag{
+				Name: "qr",
+				Usage: `Print the verification url of the device flow as a QR code, so it can be
+opened with the camera of a phone. The verification_uri_complete is used if the
+provider sends it, so the code does not need to be entered. Requires **--device**.`,
+			},
+			cli.StringFlag{
+				Name: "console-redirect-url",
+				Usage: `The redirect_uri <url> used in the **--console** flow, for providers that do not
+support the out-of-band "urn:ietf:wg:oauth:2.0:oob" value, or use a page that
+displays the code to copy. If the provider redirects to a url that is not served,
+like "http://localhost", paste the url the browser was redirected to.`,
+			},
 			cli.StringFlag{
 				Name:  "client-id",
 				Usage: "OAuth Client ID",
@@ -158,17 +382,44 @@ $ step oauth --client-id my-client-id --client-secret my-client-secret \
 				Name:  "client-secret",
 				Usage: "OAuth Client Secret",
 			},
+			cli.StringFlag{
+				Name: "env-prefix",
+				Usage: `The <prefix> of the environment variables used if **--client-id** or
+**--client-secret** are not set. The client id and secret are read from
+<prefix>CLIENT_ID and <prefix>CLIENT_SECRET. Use an empty value to disable them.`,
+				Value: "STEP_OAUTH_",
+			},
 			cli.StringFlag{
 				Name:  "account",
-				Usage: "JSON file containing account details",
+				Usage: "JSON file containing account details. Use '-' to read it from STDIN",
 			},
 			cli.StringFlag{
 				Name:  "authorization-endpoint",
 				Usage: "OAuth Authorization Endpoint",
 			},
+			cli.StringSliceFlag{
+				Name: "token-endpoint",
+				Usage: `OAuth Token Endpoint. Use the flag multiple times to set endpoints that are
+tried in order if the connection to the previous one fails.`,
+			},
 			cli.StringFlag{
-				Name:  "token-endpoint",
-				Usage: "OAuth Token Endpoint",
+				Name: "token-response-path",
+				Usage: `The dot-separated <path> of the object with the token in the responses of the
+token endpoint, for providers that do not use the standard format. For example,
+with "data" the access token is read from data.access_token. Error responses
+without the object are read in the standard format.`,
+			},
+			cli.StringSliceFlag{
+				Name: "token-param",
+				Usage: `A provider specific <key=value> parameter added to the body of the requests to
+the token endpoint. Use the flag multiple times to add multiple parameters. The
+parameters set by the flow are not overridden.`,
+			},
+			cli.BoolFlag{
+				Name: "derive-token-endpoint",
+				Usage: `Use the "token" path next to the **--authorization-endpoint** as the token
+endpoint if **--token-endpoint** is not set, e.g. https://example.org/oauth/token
+for https://example.org/oauth/authorize.`,
 			},
 			cli.BoolFlag{
 				Name:  "header",
@@ -183,8 +434,9 @@ $ step oauth --client-id my-client-id --client-secret my-client-secret \
 				Usage: "Only output the token",
 			},
 			cli.StringSliceFlag{
-				Name:  "scope",
-				Usage: "OAuth scopes",
+				Name: "scope",
+				Usage: `OAuth scopes. If it is not set, the scopes in the non-standard "default_scopes"
+property of the provider metadata are used, or "openid email" otherwise.`,
 			},
 			cli.StringFlag{
 				Name: "prompt",
@@ -195,7 +447,8 @@ OpenID standard defines the following values, but your provider may support some
     :   The Authorization Server MUST NOT display any authentication or consent user interface pages.
         An error is returned if an End-User is not already authenticated or the Client does not have
         pre-configured consent for the requested Claims or does not fulfill other conditions for
-        processing the request.
+        processing the request. The command exits with code ` + strconv.Itoa(exitInteractionRequired) + ` if the error requires the
+        user to interact with the provider.
 
     **login**
     :   The Authorization Server SHOULD prompt the End-User for reauthentication. If it cannot
@@ -211,18 +464,103 @@ OpenID standard defines the following values, but your provider may support some
         accounts that they might have current sessions for. If it cannot obtain an account selection
         choice made by the End-User, it MUST return an error, typically account_selection_required.
 `,
+			},
+			cli.StringSliceFlag{
+				Name: "require-scope",
+				Usage: `Fail if the <scope> granted by the provider does not include the given one. Use
+the flag multiple times to require multiple scopes.`,
+			},
+			cli.BoolFlag{
+				Name: "force-consent",
+				Usage: `Always display the consent screen, even if the user has already granted the
+requested scopes. It sets **--prompt** to consent and, on Google, requests offline
+access so a new refresh token is issued.`,
+			},
+			cli.IntFlag{
+				Name: "entropy",
+				Usage: `The minimum number of random <bits> in the generated state, PKCE code verifier,
+and nonce. It must be between 128 and 762. By default, the state has 190 bits, the
+code verifier 381, and the nonce 256.`,
+			},
+			cli.BoolFlag{
+				Name: "nonce",
+				Usage: `Send the nonce parameter in the authorization request even if the openid scope
+is not requested. By default, the nonce is only sent in OpenID Connect flows.`,
+			},
+			cli.StringFlag{
+				Name: "claims-request",
+				Usage: `The OIDC claims request parameter, a <json> object with the individual claims
+requested in the ID token or the userinfo response (e.g.
+'{"id_token":{"email_verified":{"essential":true}}}').`,
 			},
 			cli.BoolFlag{
 				Name:  "jwt",
 				Usage: "Generate a JWT Auth token instead of an OAuth Token (only works with service accounts)",
 			},
+			cli.BoolFlag{
+				Name: "assertion-only",
+				Usage: `Print the signed JWT assertion generated with a service account in **--account**
+and exit without sending it to the token endpoint.`,
+			},
+			cli.StringFlag{
+				Name: "assertion-key",
+				Usage: `The PKCS #11 <uri> of the RSA key that signs the JWT assertion of a service
+account in **--account**, instead of its private_key, so the key never leaves
+the HSM (e.g.
+'pkcs11:module-path=/usr/local/lib/softhsm/libsofthsm2.so;token=oauth;id=1000?pin-source=/etc/step/pin').
+It requires a step binary built with cgo.`,
+			},
+			cli.StringFlag{
+				Name: "token-auth-method",
+				Usage: `The client authentication <method> used in the token request of a service
+account in **--account**, for providers that require it in addition to the signed
+assertion, or in the **--client-credentials** flow. The client is authenticated
+with **--client-id** and **--client-secret**.
+
+: <method> is a case-sensitive string and must be one of:
+
+    **none**
+    :  Do not authenticate the client (default). It cannot be used with
+    **--client-credentials**, which uses **client_secret_post** by default.
+
+    **client_secret_post**
+    :  Send the client credentials in the request body.
+
+    **client_secret_basic**
+    :  Send the client credentials in the Authorization header.`,
+			},
+			cli.StringFlag{
+				Name: "jwt-audience",
+				Usage: `The <audience> of the token generated with **--jwt**, usually the url of the
+target service. If not set, the value of **--scope** is used for backwards
+compatibility, or the token endpoint if **--scope** is not set either.`,
+			},
 			cli.StringFlag{
 				Name:  "listen",
 				Usage: "Callback listener <address> (e.g. \":10000\")",
 			},
 			cli.StringFlag{
-				Name:  "listen-url",
-				Usage: "The redirect_uri <url> in the authorize request (e.g. \"http://127.0.0.1:10000\")",
+				Name: "loopback-redirect-host",
+				Usage: `The <host> used in the redirect_uri of the loopback flow, "127.0.0.1" or
+"localhost" for example. It only changes the redirect_uri, the local server keeps
+listening on the **--listen** address. Defaults to the IP address of the local
+server, or "127.0.0.1" if it listens on all the interfaces. As recommended in
+RFC 8252, "localhost" is only used if it is set explicitly.`,
+			},
+			cli.StringFlag{
+				Name: "listen-url",
+				Usage: `The redirect_uri <url> in the authorize request (e.g. "http://127.0.0.1:10000").
+The url is sent to the provider as is, and its path is used as the callback path
+of the local server, that keeps listening on the **--listen** address, or on a random
+port if not set. If the url has a query string, the callback must include the same
+parameters. Use it when the provider only accepts a registered redirect_uri
+that a reverse proxy forwards to the local server.`,
+			},
+			cli.StringFlag{
+				Name: "exchange-redirect-url",
+				Usage: `The redirect_uri <url> in the token request, if it must differ from the one in
+the authorize request because a proxy rewrites it. By default, the token request
+uses the same redirect_uri as the authorize request.`,
 			},
 			cli.BoolFlag{
 				Name:   "implicit",
@@ -234,12 +572,365 @@ OpenID standard defines the following values, but your provider may support some
 				Usage:  "Allows the use of insecure flows.",
 				Hidden: true,
 			},
+			cli.BoolFlag{
+				Name:   "allow-insecure-http",
+				Usage:  "Allows the use of an http:// provider for local development. Requires **--insecure** flag.",
+				Hidden: true,
+			},
+			cli.BoolFlag{
+				Name: "no-state",
+				Usage: `Do not send the state parameter in the authorization request and do not
+validate it in the callback. Use it only with providers that reject or do not
+return the state: without it the flow is vulnerable to cross-site request
+forgery (CSRF) attacks. Requires **--insecure** flag.`,
+			},
+			cli.BoolFlag{
+				Name: "quiet",
+				Usage: `Do not print the warning about the default client, the authenticated identity,
+and the token lifetime to STDERR.`,
+			},
+			cli.BoolFlag{
+				Name: "verbose-http",
+				Usage: `Print the requests to the provider and their responses to STDERR. The client
+secret, the authorization codes and the tokens are masked. Other debug messages
+are also printed.`,
+			},
+			cli.StringFlag{
+				Name: "min-tls-version",
+				Usage: `The minimum TLS <version> used in the requests to the provider. It must be
+one of **1.0**, **1.1**, **1.2**, or **1.3**.`,
+			},
+			cli.BoolFlag{
+				Name: "fail-if-no-browser",
+				Usage: `Fail immediately if a web browser cannot be opened, instead of printing the
+authorization url and waiting for the callback. Use it in automation that can
+fall back to the **--console** flow.`,
+			},
 			cli.StringFlag{
 				Name:   "browser",
 				Usage:  "Path to browser for OAuth flow (macOS only).",
 				Hidden: true,
 			},
 			flags.RedirectURL,
+			cli.StringFlag{
+				Name: "error-redirect-url",
+				Usage: `The <url> the browser is redirected to when the OAuth flow fails on the
+callback url, instead of showing the error page of the local server. The error
+message is added to the url in the error_description query parameter.`,
+			},
+			cli.BoolFlag{
+				Name:  "print-config",
+				Usage: "Print the resolved endpoints and settings and exit without running the flow",
+			},
+			cli.StringFlag{
+				Name: "discovery-file",
+				Usage: `The <file> with the discovery document of the provider, used instead of
+retrieving it, also by **--list-scopes**. If **--provider** is not set, the issuer
+in the document is used as the provider. It cannot be used with a provider in the
+registry, like google, as they do not use discovery.`,
+			},
+			cli.StringFlag{
+				Name: "discovery-accept",
+				Usage: `The <media-type> sent in the Accept header of the discovery request, for
+providers that return a different document depending on it.`,
+				Value: defaultDiscoveryAccept,
+			},
+			cli.BoolFlag{
+				Name: "list-scopes",
+				Usage: `Print the scopes supported by the provider, taken from the scopes_supported
+property of its discovery document, or of **--discovery-file**, and exit without
+running the flow.`,
+			},
+			cli.BoolFlag{
+				Name: "serve",
+				Usage: `Keep the callback server running and handle multiple authorizations. A new
+authorization starts every time a browser visits the <authorize> path relative to
+the callback URL, and each token is written as soon as it is received using the
+output flags, like **--bare** or **--out**. The default output is a JSON line
+with the round number and the requested scope in addition to the token. Use
+the **scope** query parameter to override the requested scopes of a round.`,
+			},
+			cli.StringFlag{
+				Name: "exchange-code",
+				Usage: `Exchange the authorization <code> obtained elsewhere for a token, without
+opening a browser or starting a local server. The redirect_uri used to get the
+code must be set with **--listen-url**.`,
+			},
+			cli.StringFlag{
+				Name: "code-verifier",
+				Usage: `The PKCE code <verifier> sent with **--exchange-code**. It is required if a
+code challenge was used in the authorization request.`,
+			},
+			cli.StringFlag{
+				Name: "refresh-token",
+				Usage: `Get a new token using the refresh <token> of a previous authorization, without
+opening a browser or starting a local server. The refresh token is kept in the
+output if the provider does not issue a new one.`,
+			},
+			cli.BoolFlag{
+				Name: "self-signed",
+				Usage: `Generate an ID token signed with **--signing-key** instead of using a provider.
+The token is only meant for testing services that consume ID tokens locally.`,
+			},
+			cli.StringFlag{
+				Name:  "signing-key",
+				Usage: "The private key <file>, in PEM or JWK format, used to sign the token generated with **--self-signed**.",
+			},
+			cli.StringSliceFlag{
+				Name: "claim",
+				Usage: `The <name=value> of a claim added to the token generated with **--self-signed**.
+The value is parsed as JSON if possible, so numbers, booleans, and lists can be
+used. Use the flag multiple times to add multiple claims.`,
+			},
+			cli.BoolFlag{
+				Name: "token-exchange",
+				Usage: `Exchange the token in **--subject-token** for a new one using the token exchange
+grant type defined in RFC 8693. The token endpoint is retrieved from the
+**--provider** or set using **--token-endpoint**.`,
+			},
+			cli.StringFlag{
+				Name:  "subject-token",
+				Usage: "The <token> to exchange when using **--token-exchange**",
+			},
+			cli.StringFlag{
+				Name: "subject-token-type",
+				Usage: `The <type> of the **--subject-token**. It can be a token type identifier or one of
+**access_token**, **refresh_token**, **id_token**, **jwt**, **saml1**, or **saml2**.
+If not set, **jwt** is used if the token is a JWT, and **access_token** otherwise.`,
+			},
+			cli.StringSliceFlag{
+				Name:  "audience",
+				Usage: "The logical name of the target service where the exchanged token will be used. Use the flag multiple times to set multiple audiences.",
+			},
+			cli.StringFlag{
+				Name: "requested-token-type",
+				Usage: `The <type> of the token requested when using **--token-exchange**. It can be a
+token type identifier or one of **access_token**, **refresh_token**, **id_token**,
+**jwt**, **saml1**, or **saml2**. The type of the token returned is printed as
+issued_token_type.`,
+			},
+			cli.StringFlag{
+				Name:  "actor-token",
+				Usage: "The <token> representing the identity of the acting party when using **--token-exchange**",
+			},
+			cli.StringFlag{
+				Name: "actor-token-type",
+				Usage: `The <type> of the **--actor-token**. It can be a token type identifier or one of
+**access_token**, **refresh_token**, **id_token**, **jwt**, **saml1**, or **saml2**.`,
+				Value: "access_token",
+			},
+			cli.StringFlag{
+				Name: "exchange-chain",
+				Usage: `The <file> with the list of exchanges to run after **--token-exchange**, each one
+using the token returned by the previous one as the subject token. The file is a
+JSON array of objects with the optional properties "audience" (a list),
+"scope", and "requested_token_type".`,
+			},
+			cli.DurationFlag{
+				Name: "max-clock-skew",
+				Usage: `Warn if the local clock and the clock of the provider, taken from the
+discovery response, differ by more than the given <duration> (e.g. "1m").`,
+			},
+			cli.BoolFlag{
+				Name: "cache",
+				Usage: `Cache the token in $STEPPATH/cache/oauth, in a file named by a hash of the
+provider, the client id and the scope. If a cached token has not expired it is
+printed without starting a flow, and if it has expired but it has a refresh
+token, it is refreshed. If the refresh fails and the standard input is not a
+terminal, the command fails instead of starting a new authorization. The file
+is created with 0600 permissions. While a flow that opens a browser or asks for
+a code is running, a lock file next to the cached token makes a second step
+oauth with the same provider, client id and scope wait for it and reuse its
+token.`,
+			},
+			cli.StringFlag{
+				Name:  "cache-primary",
+				Value: cachePrimaryAccess,
+				Usage: `The token whose expiration decides if a cached token is used, "access" or "id".
+With "id" the exp claim of the ID token is used instead of the expires_in of
+the access token, and the expires_in of a cached token is the remaining lifetime
+of the ID token. Requires **--cache**.`,
+			},
+			cli.BoolFlag{
+				Name: "no-reauth",
+				Usage: `Fail instead of starting a new authorization if the refresh of a cached token
+fails. If the provider rejects the refresh token with invalid_grant, because it
+has expired or has been revoked, the command returns '13'. Requires **--cache**.`,
+			},
+			cli.BoolFlag{
+				Name: "cache-list",
+				Usage: `List the tokens in $STEPPATH/cache/oauth with their provider, client id, scope,
+expiration, and whether they are still valid, and exit.`,
+			},
+			cli.BoolFlag{
+				Name: "cache-clear",
+				Usage: `Remove all the tokens in $STEPPATH/cache/oauth. Without **--cache** the command
+exits after removing them, with it a new token is obtained and cached.`,
+			},
+			cli.BoolFlag{
+				Name: "exit-status",
+				Usage: `Use the exit code to tell how the token was obtained: '0' for a new
+authorization, '10' for a cached token, and '11' for a refreshed token. See
+the EXIT CODES section.`,
+			},
+			cli.BoolFlag{
+				Name:  "no-refresh-token",
+				Usage: "Do not print the refresh token, so it is not captured in logs or terminal history",
+			},
+			cli.StringFlag{
+				Name: "out",
+				Usage: `The <file> to write the output to instead of the standard output. If the file
+is a named pipe (FIFO), the command blocks until a reader opens it.`,
+			},
+			cli.StringFlag{
+				Name: "result-callback",
+				Usage: `The <url> to POST the token JSON to, in addition to the regular output, so a
+local tool like an editor plugin can receive it. The url must use localhost or a
+loopback IP address.`,
+			},
+			cli.StringFlag{
+				Name: "header-file",
+				Usage: `The <file> to write the Authorization header to, in the curl config format, so
+it can be used with 'curl -K <file>' without passing the token in the command
+line. The ID token is used if **--oidc** is set. The file is created with 0600
+permissions.`,
+			},
+			cli.StringFlag{
+				Name:  "access-token-out",
+				Usage: "The <file> to write the access token to. The file is created with 0600 permissions.",
+			},
+			cli.StringFlag{
+				Name:  "id-token-out",
+				Usage: "The <file> to write the ID token to. The file is created with 0600 permissions.",
+			},
+			cli.StringFlag{
+				Name: "web-identity-token-file",
+				Usage: `The <file> to write the ID token to, for the AWS web identity provider set in
+AWS_WEB_IDENTITY_TOKEN_FILE. The file is replaced atomically, so the AWS SDKs
+never read a partial token. The file is created with 0600 permissions.`,
+			},
+			cli.BoolFlag{
+				Name: "describe",
+				Usage: `Output the token type, the granted scope and the expiration of the token, but
+not the token itself, so it is safe to use in shared or logged environments. If
+the access token is a JWT, its decoded claims are included.`,
+			},
+			cli.BoolFlag{
+				Name: "claims",
+				Usage: `Output the decoded header and payload of the access token, or the ID token
+if **--oidc** is set. The signature of the token is not verified. If the access
+token is not a JWT, "opaque token" is printed.`,
+			},
+			cli.BoolFlag{
+				Name: "with-claims",
+				Usage: `Output the ID token together with its decoded claims, as a JSON object with the
+properties "id_token" and "claims". The signature of the token is not verified.`,
+			},
+			cli.StringFlag{
+				Name: "identity-claim",
+				Usage: `The <name> of the ID token claim printed as the authenticated identity, e.g.
+"preferred_username" or "upn". The "sub" claim is used if the token does not
+have it.`,
+				Value: "email",
+			},
+			cli.BoolFlag{
+				Name: "git-credential",
+				Usage: `Output the access token using the git credential helper protocol, with the
+username "oauth2" and the token as the password. The "store" and "erase"
+operations sent by git are ignored.`,
+			},
+			cli.BoolFlag{
+				Name: "full-json",
+				Usage: `Output the token together with the flow metadata: the flow type, the provider,
+the endpoints, the client id, the requested scopes, and the timings.`,
+			},
+			cli.StringFlag{
+				Name: "env-file",
+				Usage: `Write the tokens to <file> in the KEY=VALUE format used by **docker run --env-file**
+or docker compose. The file contains ACCESS_TOKEN and TOKEN_TYPE, and ID_TOKEN
+and EXPIRES_IN if they are present in the response.`,
+			},
+			cli.StringFlag{
+				Name: "metrics-file",
+				Usage: `The <file> where the duration of the discovery, the token exchange and the
+whole flow are written using the Prometheus text format. The file is created
+with 0600 permissions.`,
+			},
+			cli.StringFlag{
+				Name: "audit-log",
+				Usage: `The <file> to append a JSON line to on each run, with the time, the provider,
+the flow, the granted scope and the SHA-256 hash of the access token. The token
+itself is never written. The file is rotated when it reaches
+**--audit-log-max-size**.`,
+			},
+			cli.Int64Flag{
+				Name: "audit-log-max-size",
+				Usage: `The maximum <size> in bytes of the **--audit-log** file. When a new line would
+exceed it, the file is renamed to <file>.1, the previous <file>.1 to <file>.2,
+and so on, and a new file is started. Use 0 to never rotate the file.`,
+				Value: defaultAuditLogMaxSize,
+			},
+			cli.IntFlag{
+				Name: "audit-log-max-files",
+				Usage: `The <number> of rotated **--audit-log** files to keep, the oldest one is removed.
+With 0 no rotated files are kept.`,
+				Value: defaultAuditLogMaxFiles,
+			},
+			cli.StringFlag{
+				Name: "callback-method",
+				Usage: `The HTTP <method> accepted on the callback url. Requests with a different method
+are rejected with a 405 status code. Parameters sent in a POST request body are
+also read.
+
+: <method> is a case-insensitive string and must be one of:
+
+    **GET**
+    :  Accept only GET requests.
+
+    **POST**
+    :  Accept only POST requests, e.g. if response_mode=form_post is used.
+
+    **both**
+    :  Accept GET and POST requests (default).`,
+				Value: "both",
+			},
+			cli.DurationFlag{
+				Name: "browser-timeout",
+				Usage: `The maximum <duration> to wait for the browser to send the authorization code
+to the callback url in the loopback flow (e.g. "5m").`,
+				Value: defaultBrowserTimeout,
+			},
+			cli.DurationFlag{
+				Name: "exchange-timeout",
+				Usage: `The maximum <duration> to wait for the token exchange in the loopback flow,
+counted from the moment the authorization code is received (e.g. "30s").`,
+				Value: defaultExchangeTimeout,
+			},
+			cli.DurationFlag{
+				Name: "ready-timeout",
+				Usage: `The maximum <duration> to wait for the callback server to accept connections
+before opening the browser (e.g. "10s").`,
+				Value: defaultReadyTimeout,
+			},
+			cli.DurationFlag{
+				Name: "server-read-timeout",
+				Usage: `The maximum <duration> for the callback server to read a request, including the
+body (e.g. "5s").`,
+				Value: defaultServerReadTimeout,
+			},
+			cli.DurationFlag{
+				Name: "server-write-timeout",
+				Usage: `The maximum <duration> for the callback server to write a response, counted
+from the end of the request headers. It must be longer than the token exchange
+(e.g. "1m").`,
+				Value: defaultServerWriteTimeout,
+			},
+			cli.DurationFlag{
+				Name: "server-idle-timeout",
+				Usage: `The maximum <duration> the callback server keeps an idle keep-alive connection
+open (e.g. "1s").`,
+				Value: defaultServerIdleTimeout,
+			},
 		},
 		Action: oauthCmd,
 	}
@@ -248,50 +939,296 @@ OpenID standard defines the following values, but your provider may support some
 }
 
 func oauthCmd(c *cli.Context) error {
+	start := time.Now()
+	if c.Bool("cache-list") {
+		if c.Bool("cache-clear") {
+			return errs.IncompatibleFlagWithFlag(c, "cache-list", "cache-clear")
+		}
+		entries, err := listCache(cacheDir())
+		if err != nil {
+			return err
+		}
+		return printCacheList(os.Stdout, entries, start)
+	}
+	if c.Bool("cache-clear") {
+		if err := clearCache(cacheDir()); err != nil {
+			return err
+		}
+		if !c.Bool("cache") {
+			return nil
+		}
+	}
 	opts := &options{
 		Provider:            c.String("provider"),
 		Email:               c.String("email"),
 		Console:             c.Bool("console"),
+		ConsoleRedirectURL:  c.String("console-redirect-url"),
 		Implicit:            c.Bool("implicit"),
 		CallbackListener:    c.String("listen"),
 		CallbackListenerURL: c.String("listen-url"),
+		ExchangeRedirectURL: c.String("exchange-redirect-url"),
 		CallbackPath:        "/",
+		RedirectHost:        c.String("loopback-redirect-host"),
 		TerminalRedirect:    c.String("redirect-url"),
+		ErrorRedirect:       c.String("error-redirect-url"),
 		Browser:             c.String("browser"),
+		FailIfNoBrowser:     c.Bool("fail-if-no-browser"),
+		Serve:               c.Bool("serve"),
+		MaxClockSkew:        c.Duration("max-clock-skew"),
+		DiscoveryAccept:     c.String("discovery-accept"),
+		DiscoveryFile:       expandPath(c.String("discovery-file")),
+		ScopeSet:            c.IsSet("scope"),
+		ReadyTimeout:        c.Duration("ready-timeout"),
+		ServerReadTimeout:   c.Duration("server-read-timeout"),
+		ServerWriteTimeout:  c.Duration("server-write-timeout"),
+		ServerIdleTimeout:   c.Duration("server-idle-timeout"),
+		BrowserTimeout:      c.Duration("browser-timeout"),
+		ExchangeTimeout:     c.Duration("exchange-timeout"),
+		CallbackMethod:      c.String("callback-method"),
+		TokenAuthMethod:     c.String("token-auth-method"),
+		AllowInsecureHTTP:   c.Bool("allow-insecure-http"),
+		ClaimsRequest:       c.String("claims-request"),
+		NoState:             c.Bool("no-state"),
+		ForceConsent:        c.Bool("force-consent"),
+		SendNonce:           c.Bool("nonce"),
+		Entropy:             c.Int("entropy"),
+		DeviceQR:            c.Bool("qr"),
+		TokenResponsePath:   c.String("token-response-path"),
+	}
+	if v := c.String("min-tls-version"); v != "" {
+		version, ok := tlsVersions[v]
+		if !ok {
+			return errs.InvalidFlagValue(c, "min-tls-version", v, "1.0, 1.1, 1.2, 1.3")
+		}
+		setMinTLSVersion(version)
+	}
+	if c.Bool("no-reauth") && !c.Bool("cache") {
+		return errs.RequiredWithFlag(c, "no-reauth", "cache")
+	}
+	if c.IsSet("cache-primary") {
+		switch v := c.String("cache-primary"); {
+		case v != cachePrimaryAccess && v != cachePrimaryID:
+			return errs.InvalidFlagValue(c, "cache-primary", v, "access, id")
+		case !c.Bool("cache"):
+			return errs.RequiredWithFlag(c, "cache-primary", "cache")
+		}
+	}
+	if c.Bool("verbose-http") {
+		enableHTTPDump()
+		verbose = true
+	}
+	if opts.AllowInsecureHTTP && !c.Bool("insecure") {
+		return errs.RequiredInsecureFlag(c, "allow-insecure-http")
+	}
+	if opts.NoState && !c.Bool("insecure") {
+		return errs.RequiredInsecureFlag(c, "no-state")
+	}
+	if c.IsSet("discovery-file") {
+		if c.IsSet("authorization-endpoint") {
+			return errs.IncompatibleFlagWithFlag(c, "discovery-file", "authorization-endpoint")
+		}
+		// The issuer in the document is used as the provider. The providers
+		// in the registry do not use discovery.
+		if !c.IsSet("provider") {
+			opts.Provider = ""
+		} else if _, ok := providers[opts.Provider]; ok {
+			return errs.IncompatibleFlagValue(c, "discovery-file", "provider", opts.Provider)
+		}
 	}
 	if err := opts.Validate(); err != nil {
 		return err
 	}
-	if (opts.Provider != "google" || c.IsSet("authorization-endpoint")) && !c.IsSet("client-id") {
-		return errors.New("flag '--client-id' required with '--provider'")
+	tokenParams, err := parseTokenParams(c.StringSlice("token-param"))
+	if err != nil {
+		return err
 	}
-
-	var clientID, clientSecret string
-	if opts.Implicit {
-		if !c.Bool("insecure") {
-			return errs.RequiredInsecureFlag(c, "implicit")
+	opts.TokenParams = tokenParams
+	if c.Bool("list-scopes") {
+		if _, ok := providers[opts.Provider]; ok {
+			return errors.New("flag '--list-scopes' requires the issuer url in '--provider' or '--discovery-file'")
 		}
-		if !c.IsSet("client-id") {
-			return errs.RequiredWithFlag(c, "implicit", "client-id")
+		scopes, err := listScopes(opts.Provider, opts.DiscoveryAccept, opts.DiscoveryFile)
+		if err != nil {
+			return err
 		}
-	} else {
-		clientID = defaultClientID
-		clientSecret = defaultClientNotSoSecret
+		b, err := json.MarshalIndent(scopes, "", "  ")
+		if err != nil {
+			return errors.Wrapf(err, "error marshaling scopes")
+		}
+		fmt.Println(string(b))
+		return nil
 	}
-	if c.IsSet("client-id") {
-		clientID = c.String("client-id")
-		clientSecret = c.String("client-secret")
+	if c.Bool("full-json") {
+		for _, f := range []string{"bare", "header"} {
+			if c.Bool(f) {
+				return errs.IncompatibleFlagWithFlag(c, "full-json", f)
+			}
+		}
+	}
+	if c.Bool("claims") {
+		for _, f := range []string{"bare", "header", "full-json"} {
+			if c.Bool(f) {
+				return errs.IncompatibleFlagWithFlag(c, "claims", f)
+			}
+		}
+	}
+	if c.Bool("describe") {
+		for _, f := range []string{"bare", "header", "full-json", "claims"} {
+			if c.Bool(f) {
+				return errs.IncompatibleFlagWithFlag(c, "describe", f)
+			}
+		}
+	}
+	if c.Bool("with-claims") {
+		for _, f := range []string{"bare", "header", "full-json", "claims", "describe"} {
+			if c.Bool(f) {
+				return errs.IncompatibleFlagWithFlag(c, "with-claims", f)
+			}
+		}
+	}
+	if u := c.String("result-callback"); u != "" && !isLoopbackURL(u) {
+		return errs.InvalidFlagValueMsg(c, "result-callback", u, "it must be an http or https url using localhost or a loopback IP address")
+	}
+	if c.Bool("git-credential") {
+		for _, f := range []string{"bare", "header", "full-json", "claims", "describe", "with-claims"} {
+			if c.Bool(f) {
+				return errs.IncompatibleFlagWithFlag(c, "git-credential", f)
+			}
+		}
+		// Git only expects credentials in the get operation.
+		if op := c.Args().First(); op == "store" || op == "erase" {
+			return nil
+		}
+	}
+	flagClientID, flagClientSecret := clientCredentials(c)
+	if (opts.Provider != "google" || c.IsSet("authorization-endpoint")) && flagClientID == "" {
+		return errors.New("flag '--client-id' required with '--provider'")
+	}
+
+	var clientID, clientSecret string
+	if opts.Implicit {
+		if !c.Bool("insecure") {
+			return errs.RequiredInsecureFlag(c, "implicit")
+		}
+		if flagClientID == "" {
+			return errs.RequiredWithFlag(c, "implicit", "client-id")
+		}
+	} else {
+		clientID = defaultClientID
+		clientSecret = defaultClientNotSoSecret
+	}
+	if flagClientID != "" || c.Bool("token-exchange") {
+		clientID = flagClientID
+		clientSecret = flagClientSecret
 	}
 
 	authzEp := ""
 	tokenEp := ""
 	if c.IsSet("authorization-endpoint") {
-		if !c.IsSet("token-endpoint") {
-			return errors.New("flag '--authorization-endpoint' requires flag '--token-endpoint'")
-		}
 		opts.Provider = ""
 		authzEp = c.String("authorization-endpoint")
-		tokenEp = c.String("token-endpoint")
+		switch {
+		case c.IsSet("token-endpoint"):
+			tokenEp, opts.TokenEndpoints = tokenEndpoints(c)
+		case c.Bool("derive-token-endpoint"):
+			var err error
+			if tokenEp, err = siblingTokenEndpoint(authzEp); err != nil {
+				return err
+			}
+			warnf("using the derived token endpoint %s", tokenEp)
+		default:
+			return errors.New("flag '--authorization-endpoint' requires flag '--token-endpoint'")
+		}
+	}
+
+	if c.IsSet("exchange-code") {
+		if c.Bool("token-exchange") {
+			return errs.IncompatibleFlagWithFlag(c, "exchange-code", "token-exchange")
+		}
+		if c.IsSet("account") {
+			return errs.IncompatibleFlagWithFlag(c, "exchange-code", "account")
+		}
+		// The redirect_uri must match the one used to get the code.
+		if !c.IsSet("listen-url") {
+			return errs.RequiredWithFlag(c, "exchange-code", "listen-url")
+		}
+		// The authorization endpoint is not required to exchange the code.
+		if c.IsSet("token-endpoint") {
+			opts.Provider = ""
+			tokenEp, opts.TokenEndpoints = tokenEndpoints(c)
+		}
+	}
+
+	if c.Bool("client-credentials") {
+		for _, f := range []string{"console", "device", "implicit", "token-exchange", "exchange-code", "refresh-token", "self-signed", "account"} {
+			if c.IsSet(f) {
+				return errs.IncompatibleFlagWithFlag(c, "client-credentials", f)
+			}
+		}
+		if flagClientID == "" || flagClientSecret == "" {
+			return errors.New("flag '--client-credentials' requires the '--client-id' and '--client-secret' flags")
+		}
+		if opts.TokenAuthMethod == tokenAuthNone {
+			return errs.InvalidFlagValueMsg(c, "token-auth-method", tokenAuthNone, "the client must be authenticated with '--client-credentials'")
+		}
+		// The authorization endpoint is not required in this flow.
+		if c.IsSet("token-endpoint") {
+			opts.Provider = ""
+			tokenEp, opts.TokenEndpoints = tokenEndpoints(c)
+		}
+	}
+
+	if c.Bool("device") {
+		for _, f := range []string{"console", "implicit", "token-exchange", "exchange-code", "refresh-token", "self-signed", "account"} {
+			if c.IsSet(f) {
+				return errs.IncompatibleFlagWithFlag(c, "device", f)
+			}
+		}
+	} else if c.Bool("qr") {
+		return errs.RequiredWithFlag(c, "qr", "device")
+	}
+
+	if c.IsSet("refresh-token") {
+		for _, f := range []string{"token-exchange", "exchange-code", "account"} {
+			if c.IsSet(f) {
+				return errs.IncompatibleFlagWithFlag(c, "refresh-token", f)
+			}
+		}
+		// The authorization endpoint is not required to refresh a token.
+		if c.IsSet("token-endpoint") {
+			opts.Provider = ""
+			tokenEp, opts.TokenEndpoints = tokenEndpoints(c)
+		}
+	}
+
+	if c.Bool("token-exchange") {
+		if !c.IsSet("subject-token") {
+			return errs.RequiredWithFlag(c, "token-exchange", "subject-token")
+		}
+		if c.IsSet("actor-token-type") && !c.IsSet("actor-token") {
+			return errs.RequiredWithFlag(c, "actor-token-type", "actor-token")
+		}
+		if c.IsSet("account") {
+			return errs.IncompatibleFlagWithFlag(c, "token-exchange", "account")
+		}
+		// The authorization endpoint is not required to exchange tokens.
+		if c.IsSet("token-endpoint") {
+			opts.Provider = ""
+			tokenEp, opts.TokenEndpoints = tokenEndpoints(c)
+		}
+	} else if c.IsSet("exchange-chain") {
+		return errs.RequiredWithFlag(c, "exchange-chain", "token-exchange")
+	}
+
+	if c.Bool("self-signed") {
+		if !c.IsSet("signing-key") {
+			return errs.RequiredWithFlag(c, "self-signed", "signing-key")
+		}
+		for _, f := range []string{"token-exchange", "exchange-code", "refresh-token", "account"} {
+			if c.IsSet(f) {
+				return errs.IncompatibleFlagWithFlag(c, "self-signed", f)
+			}
+		}
 	}
 
 	do2lo := false
@@ -299,8 +1236,8 @@ func oauthCmd(c *cli.Context) error {
 	// This code supports Google service accounts. Probably maybe also support JWKs?
 	if c.IsSet("account") {
 		opts.Provider = ""
-		filename := c.String("account")
-		b, err := ioutil.ReadFile(filename)
+		filename := expandPath(c.String("account"))
+		b, err := utils.ReadFile(filename)
 		if err != nil {
 			return errors.Wrapf(err, "error reading account from %s", filename)
 		}
@@ -319,9 +1256,16 @@ func oauthCmd(c *cli.Context) error {
 			authzEp = account["auth_uri"].(string)
 			tokenEp = account["token_uri"].(string)
 			clientID = account["private_key_id"].(string)
-			clientSecret = account["private_key"].(string)
+			clientSecret, _ = account["private_key"].(string)
 			issuer = account["client_email"].(string)
 			do2lo = true
+			// Fail before any request if the key cannot be used. The
+			// private_key is not used with --assertion-key.
+			if !c.IsSet("assertion-key") {
+				if _, err := parsePrivateKey(clientSecret); err != nil {
+					return errors.Wrapf(err, "error reading %s: account file contains an invalid private_key", filename)
+				}
+			}
 		} else {
 			return errors.Wrapf(err, "error reading %s: unsupported account type", filename)
 		}
@@ -335,86 +1279,693 @@ func oauthCmd(c *cli.Context) error {
 	if c.IsSet("prompt") {
 		prompt = c.String("prompt")
 	}
+	if opts.ForceConsent {
+		if c.IsSet("prompt") {
+			return errs.IncompatibleFlagWithFlag(c, "force-consent", "prompt")
+		}
+		prompt = "consent"
+	}
+
+	if m := opts.TokenAuthMethod; m != "" && m != tokenAuthNone {
+		if !do2lo && !c.Bool("client-credentials") {
+			return errors.New("flag '--token-auth-method' requires a service account in '--account' or '--client-credentials'")
+		}
+		if flagClientID == "" || flagClientSecret == "" {
+			return errors.New("flag '--token-auth-method' requires the '--client-id' and '--client-secret' flags")
+		}
+		opts.TokenAuthClientID, opts.TokenAuthSecret = flagClientID, flagClientSecret
+	}
 
 	o, err := newOauth(opts.Provider, clientID, clientSecret, authzEp, tokenEp, scope, prompt, opts)
 	if err != nil {
 		return err
 	}
 
-	var tok *token
+	var flow string
 	switch {
+	case c.Bool("token-exchange"):
+		flow = flowTokenExchange
+	case c.IsSet("exchange-code"):
+		flow = flowExchangeCode
+	case c.IsSet("refresh-token"):
+		flow = flowRefreshToken
+	case c.Bool("self-signed"):
+		flow = flowSelfSigned
+	case do2lo && c.Bool("jwt"):
+		flow = flowJWT
 	case do2lo:
-		if c.Bool("jwt") {
-			tok, err = o.DoJWTAuthorization(issuer, scope)
+		flow = flowTwoLegged
+	case c.Bool("client-credentials"):
+		flow = flowClientCredentials
+	case c.Bool("device"):
+		flow = flowDevice
+	case opts.Console:
+		flow = flowConsole
+	default:
+		flow = flowLoopback
+	}
+
+	if opts.Serve {
+		// The rounds are identified by their state.
+		for _, f := range []string{"no-state", "implicit", "full-json"} {
+			if c.Bool(f) {
+				return errs.IncompatibleFlagWithFlag(c, "serve", f)
+			}
+		}
+	}
+	if opts.Serve && flow != flowLoopback {
+		switch flow {
+		case flowConsole:
+			return errs.IncompatibleFlagWithFlag(c, "serve", "console")
+		case flowDevice:
+			return errs.IncompatibleFlagWithFlag(c, "serve", "device")
+		case flowClientCredentials:
+			return errs.IncompatibleFlagWithFlag(c, "serve", "client-credentials")
+		case flowTokenExchange:
+			return errs.IncompatibleFlagWithFlag(c, "serve", "token-exchange")
+		case flowExchangeCode:
+			return errs.IncompatibleFlagWithFlag(c, "serve", "exchange-code")
+		case flowRefreshToken:
+			return errs.IncompatibleFlagWithFlag(c, "serve", "refresh-token")
+		case flowSelfSigned:
+			return errs.IncompatibleFlagWithFlag(c, "serve", "self-signed")
+		default:
+			return errs.IncompatibleFlagWithFlag(c, "serve", "account")
+		}
+	}
+
+	if c.Bool("cache") {
+		switch flow {
+		case flowTokenExchange, flowExchangeCode, flowRefreshToken, flowSelfSigned:
+			return errs.IncompatibleFlagWithFlag(c, "cache", flow)
+		}
+		if opts.Serve {
+			return errs.IncompatibleFlagWithFlag(c, "cache", "serve")
+		}
+	}
+
+	if c.Bool("assertion-only") && flow != flowTwoLegged && flow != flowJWT {
+		return errors.New("flag '--assertion-only' requires a service account in '--account'")
+	}
+
+	if c.Bool("print-config") {
+		b, err := json.MarshalIndent(o.config(flow), "", "  ")
+		if err != nil {
+			return errors.Wrapf(err, "error marshaling configuration")
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	if uri := c.String("assertion-key"); uri != "" {
+		if flow != flowTwoLegged && flow != flowJWT {
+			return errors.New("flag '--assertion-key' requires a service account in '--account'")
+		}
+		signer, km, err := newAssertionSigner(uri)
+		if err != nil {
+			return err
+		}
+		defer km.Close()
+		o.assertionSigner = signer
+	}
+
+	if o.clientID == defaultClientID && authorizesUser(flow) && !c.Bool("quiet") {
+		warnf("using the shared default client; register your own client and use '--client-id' for anything other than testing")
+	}
+
+	if opts.Serve {
+		return o.DoServe(func(rt *roundToken) error {
+			return writeToken(c, o, flow, rt.token, time.Now(), rt)
+		})
+	}
+
+	var tok *token
+	var cacheFile string
+	if c.Bool("cache") && !c.Bool("assertion-only") {
+		cacheFile = cacheFilename(o.provider, o.tokenEndpoint, o.clientID, o.scope)
+		var refreshed bool
+		tok, refreshed, err = o.fromCache(cacheFile, c.String("cache-primary"), start)
+		_, invalidGrant := errors.Cause(err).(*invalidGrantError)
+		switch {
+		case invalidGrant && c.Bool("no-reauth"):
+			return errs.NewExitError(errors.Wrap(err, "the cached refresh token has expired or has been revoked; run without '--no-reauth' to authorize again"), exitReauthRequired)
+		case err != nil && c.Bool("no-reauth"):
+			return err
+		case err != nil && authorizesUser(flow) && !isInteractive():
+			// Do not wait for a browser or a code that will never come.
+			return errors.Wrap(err, "cannot start a new authorization in a non-interactive session; use '--cache-clear' to remove the cached token")
+		case invalidGrant:
+			warnf("the cached refresh token has expired or has been revoked, starting a new authorization")
+		case err != nil:
+			warnf("%v", err)
+		case tok != nil:
+			flow = flowCache
+			if refreshed {
+				flow = flowCacheRefresh
+			}
+		}
+		if tok == nil && authorizesUser(flow) {
+			unlock, waited, err := lockCache(cacheFile, opts.BrowserTimeout+opts.ExchangeTimeout)
+			if err != nil {
+				warnf("%v", err)
+			} else {
+				defer unlock()
+			}
+			if waited {
+				// Use the token of the step oauth that held the lock.
+				if tok, refreshed, err = o.fromCache(cacheFile, c.String("cache-primary"), time.Now()); err == nil && tok != nil {
+					flow = flowCache
+					if refreshed {
+						flow = flowCacheRefresh
+					}
+				}
+			}
+		}
+	}
+
+	switch flow {
+	case flowCache, flowCacheRefresh:
+		// The token has been read from the cache.
+	case flowTokenExchange:
+		te := &tokenExchange{
+			SubjectToken:     c.String("subject-token"),
+			SubjectTokenType: c.String("subject-token-type"),
+			ActorToken:       c.String("actor-token"),
+			ActorTokenType:   c.String("actor-token-type"),
+			Audience:         c.StringSlice("audience"),
+			RequestedType:    c.String("requested-token-type"),
+		}
+		if te.SubjectTokenType == "" {
+			te.SubjectTokenType = detectTokenType(te.SubjectToken)
+		}
+		if c.IsSet("scope") {
+			te.Scope = scope
+		}
+		if filename := c.String("exchange-chain"); filename != "" {
+			hops, err := readExchangeChain(expandPath(filename))
+			if err != nil {
+				return err
+			}
+			tok, err = o.DoTokenExchangeChain(te, hops)
 		} else {
-			tok, err = o.DoTwoLeggedAuthorization(issuer)
+			tok, err = o.DoTokenExchange(te)
 		}
-	case opts.Console:
+	case flowExchangeCode:
+		tok, err = o.DoCodeExchange(c.String("exchange-code"), c.String("code-verifier"))
+	case flowRefreshToken:
+		var refreshScope string
+		if c.IsSet("scope") {
+			refreshScope = scope
+		}
+		tok, err = o.DoRefreshToken(c.String("refresh-token"), refreshScope)
+	case flowSelfSigned:
+		var jwk *jose.JSONWebKey
+		var claims map[string]interface{}
+		if jwk, err = jose.ParseKey(expandPath(c.String("signing-key"))); err != nil {
+			return err
+		}
+		if claims, err = parseClaims(c.StringSlice("claim")); err != nil {
+			return err
+		}
+		tok, err = o.DoSelfSignedAuthorization(jwk, claims)
+	case flowJWT:
+		// For backwards compatibility an explicit scope is used as the
+		// audience if --jwt-audience is not set.
+		aud := o.tokenEndpoint
+		switch {
+		case c.IsSet("jwt-audience"):
+			aud = c.String("jwt-audience")
+		case c.IsSet("scope"):
+			aud = scope
+		}
+		tok, err = o.DoJWTAuthorization(issuer, aud)
+		if err == nil && c.Bool("assertion-only") {
+			fmt.Println(tok.AccessToken)
+			return nil
+		}
+	case flowTwoLegged:
+		if c.Bool("assertion-only") {
+			raw, err := o.twoLeggedAssertion(issuer)
+			if err != nil {
+				return err
+			}
+			fmt.Println(raw)
+			return nil
+		}
+		tok, err = o.DoTwoLeggedAuthorization(issuer)
+	case flowClientCredentials:
+		var ccScope string
+		if c.IsSet("scope") {
+			ccScope = scope
+		}
+		tok, err = o.DoClientCredentialsAuthorization(ccScope)
+	case flowDevice:
+		tok, err = o.DoDeviceAuthorization()
+	case flowConsole:
 		tok, err = o.DoManualAuthorization()
 	default:
 		tok, err = o.DoLoopbackAuthorization()
 	}
 
 	if err != nil {
+		if _, ok := errors.Cause(err).(*interactionRequiredError); ok {
+			return errs.NewExitError(err, exitInteractionRequired)
+		}
 		return err
 	}
 
-	if c.Bool("header") {
+	if required := c.StringSlice("require-scope"); len(required) > 0 {
+		if err := checkGrantedScope(tok, o.scope, required); err != nil {
+			return err
+		}
+	}
+
+	issuedAt := time.Now()
+	o.timings.Total = issuedAt.Sub(start)
+	if cacheFile != "" && flow != flowCache {
+		key := cacheKey{Provider: o.provider, TokenEndpoint: o.tokenEndpoint, ClientID: o.clientID, Scope: o.scope}
+		if err := writeCache(cacheFile, key, tok, issuedAt); err != nil {
+			warnf("error writing the token cache: %v", err)
+		}
+	}
+	if filename := c.String("metrics-file"); filename != "" {
+		if err := writeMetrics(expandPath(filename), o.provider, flow, o.timings); err != nil {
+			return err
+		}
+	}
+
+	if err := writeToken(c, o, flow, tok, issuedAt, nil); err != nil {
+		return err
+	}
+	if c.Bool("exit-status") {
+		return exitStatus(flow)
+	}
+	return nil
+}
+
+// writeToken writes the token obtained in the given flow to the outputs set in
+// the flags. In serve mode rt is the round of the token, and the default
+// output is a JSON line.
+func writeToken(c *cli.Context, o *oauth, flow string, tok *token, issuedAt time.Time, rt *roundToken) error {
+	scope := o.scope
+	if rt != nil {
+		scope = rt.RequestedScope
+	}
+
+	if filename := c.String("audit-log"); filename != "" {
+		r := newAuditRecord(o.provider, flow, scope, tok, issuedAt)
+		if err := appendAuditLog(expandPath(filename), r, c.Int64("audit-log-max-size"), c.Int("audit-log-max-files")); err != nil {
+			return err
+		}
+	}
+
+	if c.Bool("no-refresh-token") {
+		// Use a copy, the refresh token is not printed but it can still be
+		// used by the caller.
+		t := *tok
+		t.RefreshToken = ""
+		tok = &t
+	}
+
+	if filename := c.String("env-file"); filename != "" {
+		if err := writeFileAtomic(expandPath(filename), envFile(tok)); err != nil {
+			return err
+		}
+	}
+	if u := c.String("result-callback"); u != "" {
+		if err := postResult(u, tok); err != nil {
+			return err
+		}
+	}
+	if filename := c.String("header-file"); filename != "" {
+		if err := writeFileAtomic(expandPath(filename), curlConfig(authorization(tok, c.Bool("oidc")))); err != nil {
+			return err
+		}
+	}
+	if filename := c.String("access-token-out"); filename != "" {
+		if err := writeFileAtomic(expandPath(filename), []byte(tok.AccessToken)); err != nil {
+			return err
+		}
+	}
+	if filename := c.String("id-token-out"); filename != "" {
+		if tok.IDToken == "" {
+			return errors.New("the provider did not return an ID token")
+		}
+		if err := writeFileAtomic(expandPath(filename), []byte(tok.IDToken)); err != nil {
+			return err
+		}
+	}
+	if filename := c.String("web-identity-token-file"); filename != "" {
+		if tok.IDToken == "" {
+			return errors.New("the provider did not return an ID token")
+		}
+		if err := writeFileAtomic(expandPath(filename), []byte(tok.IDToken)); err != nil {
+			return err
+		}
+	}
+
+	var out bytes.Buffer
+	switch {
+	case c.Bool("describe"):
+		b, err := json.MarshalIndent(describe(tok, issuedAt), "", "  ")
+		if err != nil {
+			return errors.Wrapf(err, "error marshaling token data")
+		}
+		fmt.Fprintln(&out, string(b))
+	case c.Bool("with-claims"):
+		if tok.IDToken == "" {
+			return errors.New("the provider did not return an ID token")
+		}
+		dec, err := decodeJWT(tok.IDToken)
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(&idTokenWithClaims{
+			IDToken: tok.IDToken,
+			Claims:  dec.Payload,
+		}, "", "  ")
+		if err != nil {
+			return errors.Wrapf(err, "error marshaling token data")
+		}
+		fmt.Fprintln(&out, string(b))
+	case c.Bool("claims"):
+		s := tok.AccessToken
 		if c.Bool("oidc") {
-			fmt.Println("Authorization: Bearer", tok.IDToken)
-		} else {
-			fmt.Println("Authorization: Bearer", tok.AccessToken)
+			s = tok.IDToken
 		}
-	} else {
-		if c.Bool("bare") {
+		dec, err := decodeJWT(s)
+		if err != nil {
+			// Access tokens are not required to be JWTs.
 			if c.Bool("oidc") {
-				fmt.Println(tok.IDToken)
-			} else {
-				fmt.Println(tok.AccessToken)
+				return err
 			}
+			fmt.Fprintln(&out, accessTokenOpaque)
+			break
+		}
+		b, err := json.MarshalIndent(dec, "", "  ")
+		if err != nil {
+			return errors.Wrapf(err, "error marshaling token data")
+		}
+		fmt.Fprintln(&out, string(b))
+	case c.Bool("git-credential"):
+		out.Write(gitCredential(tok.AccessToken))
+	case c.Bool("header"):
+		fmt.Fprintln(&out, "Authorization:", authorization(tok, c.Bool("oidc")))
+	case c.Bool("bare"):
+		if c.Bool("oidc") {
+			fmt.Fprintln(&out, tok.IDToken)
 		} else {
-			b, err := json.MarshalIndent(tok, "", "  ")
-			if err != nil {
-				return errors.Wrapf(err, "error marshaling token data")
-			}
-			fmt.Println(string(b))
+			fmt.Fprintln(&out, tok.AccessToken)
+		}
+	case rt != nil:
+		// JSON lines in serve mode.
+		b, err := json.Marshal(&roundToken{Round: rt.Round, RequestedScope: rt.RequestedScope, token: tok})
+		if err != nil {
+			return errors.Wrapf(err, "error marshaling token data")
+		}
+		fmt.Fprintln(&out, string(b))
+	default:
+		var v interface{} = tok
+		if c.Bool("full-json") {
+			v = o.envelope(flow, tok)
 		}
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return errors.Wrapf(err, "error marshaling token data")
+		}
+		fmt.Fprintln(&out, string(b))
+	}
+
+	if err := writeOutput(expandPath(c.String("out")), out.Bytes()); err != nil {
+		return err
 	}
 
+	// The identity and the remaining lifetime are only useful in the human
+	// readable output.
+	if !c.Bool("quiet") && !c.Bool("bare") && !c.Bool("header") && !c.Bool("claims") && !c.Bool("describe") && !c.Bool("with-claims") && !c.Bool("git-credential") {
+		if id := identity(tok.IDToken, c.String("identity-claim")); id != "" {
+			fmt.Fprintf(os.Stderr, "Authenticated as %s\n", id)
+		}
+		if tok.ExpiresIn > 0 {
+			fmt.Fprintf(os.Stderr, "The token expires in %s\n", lifetime(tok.ExpiresIn, time.Since(issuedAt)))
+		}
+	}
 	return nil
 }
 
+// authorizesUser returns true if the user authorizes the client in the given
+// flow, that is, in the authorization code, implicit, and device flows. The
+// warning about the default client is only printed for these flows.
+func authorizesUser(flow string) bool {
+	switch flow {
+	case flowLoopback, flowConsole, flowDevice:
+		return true
+	default:
+		return false
+	}
+}
+
+// Exit codes used with --exit-status.
+const (
+	exitStatusCached    = 10
+	exitStatusRefreshed = 11
+)
+
+// exitInteractionRequired is the exit code used if the silent authentication
+// with prompt=none fails. It does not overlap with the codes used by step on
+// errors, panics, or unknown help topics.
+const exitInteractionRequired = 12
+
+// interactionRequiredErrors are the errors returned by the provider when the
+// authentication with prompt=none requires the user, as defined in OpenID
+// Connect Core 1.0, section 3.1.2.6.
+var interactionRequiredErrors = map[string]bool{
+	"interaction_required":       true,
+	"login_required":             true,
+	"account_selection_required": true,
+	"consent_required":           true,
+}
+
+// interactionRequiredError is the error returned if the silent authentication
+// fails, the flow can be retried without prompt=none.
+type interactionRequiredError struct {
+	Err     string
+	ErrDesc string
+}
+
+func (e *interactionRequiredError) Error() string {
+	msg := "Failed to authenticate: " + e.Err
+	if e.ErrDesc != "" {
+		msg += ". " + e.ErrDesc
+	}
+	return msg + ". The silent authentication failed, retry without '--prompt none'"
+}
+
+// exitReauthRequired is the exit code used with --no-reauth if the refresh
+// token in the cache has expired or has been revoked.
+const exitReauthRequired = 13
+
+// invalidGrantError is the error returned if the provider rejects a refresh
+// token, because it has expired or has been revoked. A new authorization is
+// required.
+type invalidGrantError struct {
+	ErrDesc string
+}
+
+func (e *invalidGrantError) Error() string {
+	return "Error refreshing token: invalid_grant. " + e.ErrDesc
+}
+
+// exitStatus returns an error without message that exits with the code of the
+// given flow, or nil if the flow did a new authorization.
+func exitStatus(flow string) error {
+	switch flow {
+	case flowCache:
+		return errs.NewExitError(errors.New(""), exitStatusCached)
+	case flowCacheRefresh, flowRefreshToken:
+		return errs.NewExitError(errors.New(""), exitStatusRefreshed)
+	default:
+		return nil
+	}
+}
+
+// lifetime returns the remaining lifetime of a token issued elapsed time ago
+// with the given expires_in value in seconds.
+func lifetime(expiresIn int, elapsed time.Duration) time.Duration {
+	d := time.Duration(expiresIn)*time.Second - elapsed
+	if d < 0 {
+		return 0
+	}
+	return d.Round(time.Second)
+}
+
+// tokenEndpoints returns the first --token-endpoint and the ones used on
+// connection failure.
+func tokenEndpoints(c *cli.Context) (string, []string) {
+	eps := c.StringSlice("token-endpoint")
+	if len(eps) == 0 {
+		return "", nil
+	}
+	return eps[0], eps[1:]
+}
+
+// parseTokenParams parses the values of the --token-param flag. Each value has
+// the format key=value.
+func parseTokenParams(values []string) (url.Values, error) {
+	params := url.Values{}
+	for _, s := range values {
+		i := strings.Index(s, "=")
+		if i <= 0 {
+			return nil, errors.Errorf("invalid value '%s' for flag '--token-param': it must have the format key=value", s)
+		}
+		params.Add(s[:i], s[i+1:])
+	}
+	return params, nil
+}
+
+// siblingTokenEndpoint returns the "token" url in the same path as the given
+// authorization endpoint.
+func siblingTokenEndpoint(authzEp string) (string, error) {
+	u, err := url.Parse(authzEp)
+	if err != nil || u.Host == "" {
+		return "", errors.Errorf("invalid value '%s' for flag '--authorization-endpoint'", authzEp)
+	}
+	u.Path = path.Join(path.Dir(strings.TrimRight(u.Path, "/")), "token")
+	u.RawPath = ""
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String(), nil
+}
+
+// clientCredentials returns the client id and secret set in the flags. If a
+// flag is not set, the value is read from the environment variable
+// <prefix>CLIENT_ID or <prefix>CLIENT_SECRET, where prefix is the value of the
+// --env-prefix flag.
+func clientCredentials(c *cli.Context) (clientID, clientSecret string) {
+	prefix := c.String("env-prefix")
+	clientID, clientSecret = c.String("client-id"), c.String("client-secret")
+	if !c.IsSet("client-id") && prefix != "" {
+		clientID = os.Getenv(prefix + "CLIENT_ID")
+	}
+	if !c.IsSet("client-secret") && prefix != "" {
+		clientSecret = os.Getenv(prefix + "CLIENT_SECRET")
+	}
+	return
+}
+
 type options struct {
 	Provider            string
 	Email               string
 	Console             bool
+	ConsoleRedirectURL  string
 	Implicit            bool
 	CallbackListener    string
 	CallbackListenerURL string
 	CallbackPath        string
+	ExchangeRedirectURL string
+	RedirectHost        string
 	TerminalRedirect    string
+	ErrorRedirect       string
 	Browser             string
+	FailIfNoBrowser     bool
+	Serve               bool
+	MaxClockSkew        time.Duration
+	DiscoveryAccept     string
+	DiscoveryFile       string
+	ScopeSet            bool
+	ReadyTimeout        time.Duration
+	ServerReadTimeout   time.Duration
+	ServerWriteTimeout  time.Duration
+	ServerIdleTimeout   time.Duration
+	BrowserTimeout      time.Duration
+	ExchangeTimeout     time.Duration
+	CallbackMethod      string
+	TokenAuthMethod     string
+	TokenAuthClientID   string
+	TokenAuthSecret     string
+	AllowInsecureHTTP   bool
+	ClaimsRequest       string
+	NoState             bool
+	ForceConsent        bool
+	SendNonce           bool
+	Entropy             int
+	DeviceQR            bool
+	TokenResponsePath   string
+	TokenEndpoints      []string
+	TokenParams         url.Values
 }
 
 // Validate validates the options.
 func (o *options) Validate() error {
-	if o.Provider != "google" && !strings.HasPrefix(o.Provider, "https://") {
-		return errors.New("use a valid provider: google")
+	// Providers not in the registry are set using their issuer url.
+	if _, ok := providers[o.Provider]; !ok && (o.Provider != "" || o.DiscoveryFile == "") {
+		if !strings.HasPrefix(o.Provider, "https://") {
+			if !o.AllowInsecureHTTP || !strings.HasPrefix(o.Provider, "http://") {
+				return errors.Errorf("use a valid provider: %s", providerNames())
+			}
+		}
+		u, err := url.Parse(o.Provider)
+		if err != nil || u.Host == "" {
+			return errors.Errorf("invalid value '%s' for flag '--provider'", o.Provider)
+		}
+		o.Provider = strings.TrimRight(o.Provider, "/")
 	}
 	if o.CallbackListener != "" {
 		if _, _, err := net.SplitHostPort(o.CallbackListener); err != nil {
 			return errors.Wrapf(err, "invalid value '%s' for flag '--listen'", o.CallbackListener)
 		}
 	}
+	if o.ExchangeRedirectURL != "" {
+		if u, err := url.Parse(o.ExchangeRedirectURL); err != nil || u.Scheme == "" {
+			return errors.Errorf("invalid value '%s' for flag '--exchange-redirect-url'", o.ExchangeRedirectURL)
+		}
+	}
 	if o.CallbackListenerURL != "" {
 		u, err := url.Parse(o.CallbackListenerURL)
-		if err != nil || u.Scheme == "" {
+		if err != nil {
 			return errors.Wrapf(err, "invalid value '%s' for flag '--listen-url'", o.CallbackListenerURL)
 		}
+		if u.Scheme == "" {
+			return errors.Errorf("invalid value '%s' for flag '--listen-url': missing scheme", o.CallbackListenerURL)
+		}
 		if u.Path != "" {
 			o.CallbackPath = u.Path
 		}
 	}
+	if o.RedirectHost != "" {
+		if o.RedirectHost != "localhost" {
+			if ip := net.ParseIP(o.RedirectHost); ip == nil || !ip.IsLoopback() {
+				return errors.Errorf("invalid value '%s' for flag '--loopback-redirect-host': it must be localhost or a loopback IP address", o.RedirectHost)
+			}
+		}
+	}
+	if o.TokenResponsePath != "" {
+		for _, k := range strings.Split(o.TokenResponsePath, ".") {
+			if k == "" {
+				return errors.Errorf("invalid value '%s' for flag '--token-response-path': it must be a dot-separated list of keys", o.TokenResponsePath)
+			}
+		}
+	}
+	switch o.TokenAuthMethod {
+	case "", tokenAuthNone, tokenAuthPost, tokenAuthBasic:
+	default:
+		return errors.Errorf("invalid value '%s' for flag '--token-auth-method': options are %s, %s, or %s",
+			o.TokenAuthMethod, tokenAuthNone, tokenAuthPost, tokenAuthBasic)
+	}
+	switch strings.ToUpper(o.CallbackMethod) {
+	case "", "BOTH", http.MethodGet, http.MethodPost:
+	default:
+		return errors.Errorf("invalid value '%s' for flag '--callback-method': options are GET, POST, or both", o.CallbackMethod)
+	}
+	if o.Entropy != 0 && (o.Entropy < minEntropy || o.Entropy > maxEntropy) {
+		return errors.Errorf("invalid value '%d' for flag '--entropy': it must be between %d and %d", o.Entropy, minEntropy, maxEntropy)
+	}
+	if o.ClaimsRequest != "" {
+		var v map[string]interface{}
+		if err := json.Unmarshal([]byte(o.ClaimsRequest), &v); err != nil {
+			return errors.Wrapf(err, "invalid value '%s' for flag '--claims-request': it must be a JSON object", o.ClaimsRequest)
+		}
+	}
 	return nil
 }
 
@@ -422,170 +1973,606 @@ type oauth struct {
 	provider            string
 	clientID            string
 	clientSecret        string
+	assertionSigner     jose.OpaqueSigner
 	scope               string
+	audience            string
 	prompt              string
 	loginHint           string
 	redirectURI         string
+	exchangeRedirectURI string
 	tokenEndpoint       string
+	tokenEndpoints      []string // Used on connection failure
+	tokenParams         url.Values
+	tokenMapper         tokenMapper
 	authzEndpoint       string
+	deviceAuthzEndpoint string
 	userInfoEndpoint    string // For testing
 	state               string
 	codeChallenge       string
 	nonce               string
 	implicit            bool
+	consoleRedirectURI  string
 	CallbackListener    string
 	CallbackListenerURL string
 	CallbackPath        string
+	AuthURLHook         func(*url.URL) error // Modifies the authorization url
+	redirectHost        string
+	noState             bool
+	forceConsent        bool
+	sendNonce           bool
+	entropy             int
+	deviceQR            bool
 	terminalRedirect    string
+	errorRedirect       string
 	browser             string
+	failIfNoBrowser     bool
+	serve               bool
+	invalidRequests     int
+	codeReceived        bool
+	readyTimeout        time.Duration
+	serverReadTimeout   time.Duration
+	serverWriteTimeout  time.Duration
+	serverIdleTimeout   time.Duration
+	browserTimeout      time.Duration
+	exchangeTimeout     time.Duration
+	callbackMethod      string
+	tokenAuthMethod     string
+	tokenAuthClientID   string
+	tokenAuthSecret     string
+	timings             timings
+	claimsRequest       string
+	mu                  sync.Mutex
 	errCh               chan error
 	tokCh               chan *token
+	rounds              map[string]*serveRound // Used in serve mode
+	lastRound           int
+	roundCh             chan *roundToken
+	codeCh              chan struct{}
+	done                chan struct{}
 }
 
 func newOauth(provider, clientID, clientSecret, authzEp, tokenEp, scope, prompt string, opts *options) (*oauth, error) {
-	state, err := randutil.Alphanumeric(32)
+	state, challenge, nonce, err := newSecrets(opts.Entropy)
 	if err != nil {
 		return nil, err
 	}
 
-	challenge, err := randutil.Alphanumeric(64)
+	userinfoEp, deviceEp, audience := "", "", ""
+	var discovery time.Duration
+	var mapper tokenMapper
+	if p, ok := providers[provider]; ok {
+		authzEp, tokenEp, userinfoEp = p.AuthorizationEndpoint, p.TokenEndpoint, p.UserInfoEndpoint
+		deviceEp = p.DeviceAuthorizationEndpoint
+		mapper = p.TokenMapper
+	} else if authzEp == "" && tokenEp == "" {
+		var d map[string]interface{}
+		if opts.DiscoveryFile != "" {
+			if d, err = readDiscovery(opts.DiscoveryFile); err != nil {
+				return nil, err
+			}
+			if iss, ok := d["issuer"].(string); ok && provider == "" {
+				provider = iss
+			}
+		} else {
+			t := time.Now()
+			var h http.Header
+			if d, h, err = disco(provider, opts.DiscoveryAccept); err != nil {
+				return nil, err
+			}
+			discovery = time.Since(t)
+			if opts.MaxClockSkew > 0 {
+				checkClockSkew(h.Get("Date"), opts.MaxClockSkew)
+			}
+		}
+
+		if _, ok := d["authorization_endpoint"]; !ok {
+			return nil, errors.New("missing 'authorization_endpoint' in provider metadata")
+		}
+		if _, ok := d["token_endpoint"]; !ok {
+			return nil, errors.New("missing 'token_endpoint' in provider metadata")
+		}
+		authzEp = d["authorization_endpoint"].(string)
+		tokenEp = d["token_endpoint"].(string)
+		if ep, ok := d["userinfo_endpoint"].(string); ok {
+			userinfoEp = ep
+		}
+		if ep, ok := d["device_authorization_endpoint"].(string); ok {
+			deviceEp = ep
+		}
+		// Some providers advertise the scopes and audience they expect.
+		if s := discoveryDefaultScope(d); s != "" && !opts.ScopeSet {
+			debugf("using the scope %q in the provider metadata", s)
+			scope = s
+		}
+		if aud, ok := d["default_audience"].(string); ok && aud != "" {
+			debugf("using the audience %q in the provider metadata", aud)
+			audience = aud
+		}
+		if hasScope(scope, "openid") && !isOIDC(d) {
+			warnf("the provider does not look like an OpenID Connect provider, the 'openid' scope won't produce an ID token")
+		}
+	}
+	if opts.TokenResponsePath != "" {
+		mapper = nestedTokenMapper(strings.Split(opts.TokenResponsePath, ".")...)
+	}
+
+	return &oauth{
+		provider:            provider,
+		clientID:            clientID,
+		clientSecret:        clientSecret,
+		scope:               scope,
+		audience:            audience,
+		prompt:              prompt,
+		authzEndpoint:       authzEp,
+		tokenEndpoint:       tokenEp,
+		userInfoEndpoint:    userinfoEp,
+		deviceAuthzEndpoint: deviceEp,
+		loginHint:           opts.Email,
+		state:               state,
+		codeChallenge:       challenge,
+		nonce:               nonce,
+		implicit:            opts.Implicit,
+		consoleRedirectURI:  opts.ConsoleRedirectURL,
+		CallbackListener:    opts.CallbackListener,
+		CallbackListenerURL: opts.CallbackListenerURL,
+		exchangeRedirectURI: opts.ExchangeRedirectURL,
+		CallbackPath:        opts.CallbackPath,
+		terminalRedirect:    opts.TerminalRedirect,
+		errorRedirect:       opts.ErrorRedirect,
+		browser:             opts.Browser,
+		failIfNoBrowser:     opts.FailIfNoBrowser,
+		serve:               opts.Serve,
+		readyTimeout:        opts.ReadyTimeout,
+		serverReadTimeout:   opts.ServerReadTimeout,
+		serverWriteTimeout:  opts.ServerWriteTimeout,
+		serverIdleTimeout:   opts.ServerIdleTimeout,
+		browserTimeout:      opts.BrowserTimeout,
+		exchangeTimeout:     opts.ExchangeTimeout,
+		callbackMethod:      strings.ToUpper(opts.CallbackMethod),
+		tokenAuthMethod:     opts.TokenAuthMethod,
+		tokenAuthClientID:   opts.TokenAuthClientID,
+		tokenAuthSecret:     opts.TokenAuthSecret,
+		claimsRequest:       opts.ClaimsRequest,
+		redirectHost:        opts.RedirectHost,
+		noState:             opts.NoState,
+		forceConsent:        opts.ForceConsent,
+		sendNonce:           opts.SendNonce,
+		entropy:             opts.Entropy,
+		deviceQR:            opts.DeviceQR,
+		tokenEndpoints:      opts.TokenEndpoints,
+		tokenParams:         opts.TokenParams,
+		tokenMapper:         mapper,
+		timings:             timings{Discovery: discovery},
+		errCh:               make(chan error),
+		tokCh:               make(chan *token),
+		rounds:              make(map[string]*serveRound),
+		roundCh:             make(chan *roundToken),
+		codeCh:              make(chan struct{}, 1),
+		done:                make(chan struct{}),
+	}, nil
+}
+
+// expandPath expands the environment variables and a leading "~/" in the given
+// file path, so paths like "~/creds.json" or "$HOME/creds.json" can be used in
+// flags even if the shell does not expand them.
+func expandPath(name string) string {
+	name = os.ExpandEnv(name)
+	if strings.HasPrefix(filepath.ToSlash(name), "~/") {
+		return filepath.Join(config.Home(), name[2:])
+	}
+	return name
+}
+
+// oauthConfig is the resolved configuration printed with --print-config.
+type oauthConfig struct {
+	Flow                  string `json:"flow"`
+	Provider              string `json:"provider,omitempty"`
+	AuthorizationEndpoint string `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint         string `json:"token_endpoint,omitempty"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint,omitempty"`
+	ClientID              string `json:"client_id"`
+	Scope                 string `json:"scope"`
+	RedirectURI           string `json:"redirect_uri,omitempty"`
+}
+
+// tokenEnvelope is the output of --full-json. It wraps the token with the
+// configuration and the timings of the flow used to get it.
+type tokenEnvelope struct {
+	*oauthConfig
+	Token   *token          `json:"token"`
+	Timings envelopeTimings `json:"timings"`
+}
+
+type envelopeTimings struct {
+	Discovery float64 `json:"discovery_seconds"`
+	Exchange  float64 `json:"exchange_seconds"`
+	Total     float64 `json:"total_seconds"`
+}
+
+// envelope returns the token wrapped with the metadata of the given flow.
+func (o *oauth) envelope(flow string, tok *token) *tokenEnvelope {
+	return &tokenEnvelope{
+		oauthConfig: o.config(flow),
+		Token:       tok,
+		Timings: envelopeTimings{
+			Discovery: o.timings.Discovery.Seconds(),
+			Exchange:  o.timings.Exchange.Seconds(),
+			Total:     o.timings.Total.Seconds(),
+		},
+	}
+}
+
+// config returns the resolved configuration for the given flow. The client
+// secret is never included.
+func (o *oauth) config(flow string) *oauthConfig {
+	var redirectURI string
+	switch {
+	case o.redirectURI != "":
+		// The flow has already run.
+		redirectURI = o.redirectURI
+	case flow == flowConsole:
+		redirectURI = o.oobRedirectURI()
+	case flow == flowExchangeCode:
+		redirectURI = o.CallbackListenerURL
+	case flow == flowLoopback:
+		switch {
+		case o.CallbackListenerURL != "":
+			redirectURI = o.CallbackListenerURL
+		case o.CallbackListener != "":
+			host, port, _ := net.SplitHostPort(o.CallbackListener)
+			if port == "0" {
+				port = "<random>"
+			}
+			redirectURI = "http://" + net.JoinHostPort(o.loopbackHost(host), port)
+		default:
+			redirectURI = "http://" + net.JoinHostPort(o.loopbackHost(""), "<random>")
+		}
+	}
+	return &oauthConfig{
+		Flow:                  flow,
+		Provider:              o.provider,
+		AuthorizationEndpoint: o.authzEndpoint,
+		TokenEndpoint:         o.tokenEndpoint,
+		UserInfoEndpoint:      o.userInfoEndpoint,
+		ClientID:              o.clientID,
+		Scope:                 o.scope,
+		RedirectURI:           redirectURI,
+	}
+}
+
+// Limits of the --entropy flag. The maximum is the entropy of 128 alphanumeric
+// characters, the maximum length of a PKCE code verifier.
+const (
+	minEntropy = 128
+	maxEntropy = 762
+)
+
+// secretLengths returns the length of the state, PKCE code verifier, and nonce
+// with at least the given entropy in bits. If bits is 0, it returns the
+// default lengths.
+func secretLengths(bits int) (state, verifier, nonce int) {
+	if bits == 0 {
+		return 32, 64, 64
+	}
+	// An alphanumeric character has log2(62) bits, and a hex character 4.
+	n := int(math.Ceil(float64(bits) / math.Log2(62)))
+	verifier = n
+	if verifier < 43 {
+		// Minimum length of a code verifier, RFC 7636, section 4.1.
+		verifier = 43
+	}
+	return n, verifier, (bits + 3) / 4
+}
+
+// newSecrets generates the state, PKCE code verifier, and nonce used in an
+// authorization request, with the given entropy in bits, or the default one
+// if bits is 0.
+func newSecrets(bits int) (state, challenge, nonce string, err error) {
+	stateLen, verifierLen, nonceLen := secretLengths(bits)
+	if state, err = randutil.Alphanumeric(stateLen); err != nil {
+		return
+	}
+	if challenge, err = randutil.Alphanumeric(verifierLen); err != nil {
+		return
+	}
+	nonce, err = randutil.Hex(nonceLen)
+	return
+}
+
+// disco retrieves the discovery document of the given provider. It returns the
+// metadata and the headers of the response. The accept value is sent in the
+// Accept header, application/json is used if it is empty.
+func disco(provider, accept string) (map[string]interface{}, http.Header, error) {
+	u, err := discoveryURL(provider)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if accept == "" {
+		accept = defaultDiscoveryAccept
+	}
+	resp, err := withRetry(func() (*http.Response, error) {
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", accept)
+		return httpClient.Do(req)
+	})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error retrieving %s", u.String())
 	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error retrieving %s", u.String())
+	}
+	details, err := parseDiscovery(b, u.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	return details, resp.Header, nil
+}
 
-	nonce, err := randutil.Hex(64) // 256 bits
+// readDiscovery reads the discovery document in the given file.
+func readDiscovery(filename string) (map[string]interface{}, error) {
+	b, err := utils.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
+	return parseDiscovery(b, filename)
+}
 
-	switch provider {
-	case "google":
-		return &oauth{
-			provider:            provider,
-			clientID:            clientID,
-			clientSecret:        clientSecret,
-			scope:               scope,
-			prompt:              prompt,
-			authzEndpoint:       "https://accounts.google.com/o/oauth2/v2/auth",
-			tokenEndpoint:       "https://www.googleapis.com/oauth2/v4/token",
-			userInfoEndpoint:    "https://www.googleapis.com/oauth2/v3/userinfo",
-			loginHint:           opts.Email,
-			state:               state,
-			codeChallenge:       challenge,
-			nonce:               nonce,
-			implicit:            opts.Implicit,
-			CallbackListener:    opts.CallbackListener,
-			CallbackListenerURL: opts.CallbackListenerURL,
-			CallbackPath:        opts.CallbackPath,
-			terminalRedirect:    opts.TerminalRedirect,
-			browser:             opts.Browser,
-			errCh:               make(chan error),
-			tokCh:               make(chan *token),
-		}, nil
-	default:
-		userinfoEp := ""
-		if authzEp == "" && tokenEp == "" {
-			d, err := disco(provider)
-			if err != nil {
-				return nil, err
-			}
+// parseDiscovery parses the discovery document b read from the given source.
+func parseDiscovery(b []byte, source string) (map[string]interface{}, error) {
+	details := make(map[string]interface{})
+	if err := json.Unmarshal(b, &details); err != nil {
+		return nil, errors.Wrapf(err, "error reading %s: unsupported format", source)
+	}
+	return details, nil
+}
 
-			if _, ok := d["authorization_endpoint"]; !ok {
-				return nil, errors.New("missing 'authorization_endpoint' in provider metadata")
-			}
-			if _, ok := d["token_endpoint"]; !ok {
-				return nil, errors.New("missing 'token_endpoint' in provider metadata")
-			}
-			authzEp = d["authorization_endpoint"].(string)
-			tokenEp = d["token_endpoint"].(string)
-			userinfoEp = d["token_endpoint"].(string)
-		}
-		return &oauth{
-			provider:            provider,
-			clientID:            clientID,
-			clientSecret:        clientSecret,
-			scope:               scope,
-			prompt:              prompt,
-			authzEndpoint:       authzEp,
-			tokenEndpoint:       tokenEp,
-			userInfoEndpoint:    userinfoEp,
-			loginHint:           opts.Email,
-			state:               state,
-			codeChallenge:       challenge,
-			nonce:               nonce,
-			implicit:            opts.Implicit,
-			CallbackListener:    opts.CallbackListener,
-			CallbackListenerURL: opts.CallbackListenerURL,
-			CallbackPath:        opts.CallbackPath,
-			terminalRedirect:    opts.TerminalRedirect,
-			browser:             opts.Browser,
-			errCh:               make(chan error),
-			tokCh:               make(chan *token),
-		}, nil
-	}
-}
-
-func disco(provider string) (map[string]interface{}, error) {
-	u, err := url.Parse(provider)
+// listScopes returns the scopes_supported property of the discovery document
+// of the given provider, requested with the given Accept header, or read from
+// the given file if it is not empty.
+func listScopes(provider, accept, discoveryFile string) ([]string, error) {
+	var d map[string]interface{}
+	var err error
+	if discoveryFile != "" {
+		d, err = readDiscovery(discoveryFile)
+	} else {
+		d, _, err = disco(provider, accept)
+	}
 	if err != nil {
 		return nil, err
 	}
+	v, ok := d["scopes_supported"].([]interface{})
+	if !ok {
+		return nil, errors.New("the provider does not publish the supported scopes")
+	}
+	scopes := make([]string, 0, len(v))
+	for _, s := range v {
+		if s, ok := s.(string); ok {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes, nil
+}
+
+// discoveryURL returns the url of the discovery document of the given
+// provider. The provider can be the issuer, with or without trailing slashes,
+// or the full url of the discovery document.
+func discoveryURL(provider string) (*url.URL, error) {
+	u, err := url.Parse(provider)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing provider %s", provider)
+	}
 	// TODO: OIDC and OAuth specify two different ways of constructing this
 	// URL. This is the OIDC way. Probably want to try both. See
 	// https://tools.ietf.org/html/rfc8414#section-5
-	if !strings.Contains(u.Path, "/.well-known/openid-configuration") {
-		u.Path = path.Join(u.Path, "/.well-known/openid-configuration")
+	u.Path = strings.TrimRight(u.Path, "/")
+	if !strings.HasSuffix(u.Path, "/.well-known/openid-configuration") {
+		u.Path += "/.well-known/openid-configuration"
 	}
-	resp, err := http.Get(u.String())
-	if err != nil {
-		return nil, errors.Wrapf(err, "error retrieving %s", u.String())
+	u.RawPath = ""
+	return u, nil
+}
+
+// checkGrantedScope returns an error if the scope granted in the token does
+// not include all the required ones. If the token does not have a scope, the
+// granted scope is the requested one, as defined in RFC 6749, section 5.1.
+func checkGrantedScope(tok *token, requested string, required []string) error {
+	granted := tok.Scope
+	if granted == "" {
+		granted = requested
+	}
+	for _, s := range required {
+		if !hasScope(granted, s) {
+			return errors.Errorf("the granted scope '%s' does not include the required scope '%s'", granted, s)
+		}
 	}
-	defer resp.Body.Close()
-	b, err := ioutil.ReadAll(resp.Body)
+	return nil
+}
+
+// isOIDC returns true if the discovery document contains OpenID Connect
+// specific metadata.
+func isOIDC(d map[string]interface{}) bool {
+	_, jwks := d["jwks_uri"]
+	_, algs := d["id_token_signing_alg_values_supported"]
+	return jwks || algs
+}
+
+// discoveryDefaultScope returns the space-delimited scopes in the non-standard
+// "default_scopes" property of the discovery document. The property can be a
+// list of strings or a space-delimited string.
+func discoveryDefaultScope(d map[string]interface{}) string {
+	switch v := d["default_scopes"].(type) {
+	case string:
+		return strings.Join(strings.Fields(v), " ")
+	case []interface{}:
+		var scopes []string
+		for _, s := range v {
+			if s, ok := s.(string); ok && s != "" {
+				scopes = append(scopes, s)
+			}
+		}
+		return strings.Join(scopes, " ")
+	default:
+		return ""
+	}
+}
+
+// hasScope returns true if the space-delimited list of scopes contains the
+// given one.
+func hasScope(scope, s string) bool {
+	for _, v := range strings.Fields(scope) {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkClockSkew compares the given HTTP Date header with the local clock and
+// prints a warning if the difference is greater than max. A skewed clock
+// usually causes confusing errors like invalid_grant or token not yet valid.
+func checkClockSkew(date string, max time.Duration) {
+	if date == "" {
+		return
+	}
+	t, err := http.ParseTime(date)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error retrieving %s", u.String())
+		return
 	}
-	details := make(map[string]interface{})
-	if err = json.Unmarshal(b, &details); err != nil {
-		return nil, errors.Wrapf(err, "error reading %s: unsupported format", u.String())
+	skew := time.Since(t)
+	if skew < 0 {
+		skew = -skew
+	}
+	// The Date header has a resolution of one second.
+	if skew > max+time.Second {
+		warnf("the local clock differs from the provider clock by %s, tokens might be rejected", skew.Round(time.Second))
+	}
+}
+
+// warnf prints a warning message to stderr.
+func warnf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "warning: "+format+"\n", args...)
+}
+
+// verbose enables the debug messages, it is set with --verbose-http.
+var verbose bool
+
+// debugf prints a debug message to stderr if verbose is set.
+func debugf(format string, args ...interface{}) {
+	if verbose {
+		fmt.Fprintf(os.Stderr, "debug: "+format+"\n", args...)
 	}
-	return details, err
 }
 
 // NewServer creates http server
 func (o *oauth) NewServer() (*httptest.Server, error) {
-	if o.CallbackListener == "" {
-		return httptest.NewServer(o), nil
-	}
-	host, port, err := net.SplitHostPort(o.CallbackListener)
-	if err != nil {
-		return nil, err
+	var host, port string
+	if o.CallbackListener != "" {
+		var err error
+		if host, port, err = net.SplitHostPort(o.CallbackListener); err != nil {
+			return nil, err
+		}
 	}
 	if host == "" {
 		host = "127.0.0.1"
 	}
-	l, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if port == "" {
+		port = "0"
+	}
+	address := net.JoinHostPort(host, port)
+	lc := net.ListenConfig{Control: reuseAddr}
+	l, err := lc.Listen(context.Background(), "tcp", address)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error listening on %s", o.CallbackListener)
+		return nil, errors.Wrapf(err, "error listening on %s", address)
+	}
+	addr, ok := l.Addr().(*net.TCPAddr)
+	if !ok {
+		l.Close()
+		return nil, errors.Errorf("error parsing %s", l.Addr().String())
+	}
+	readTimeout, writeTimeout, idleTimeout := o.serverReadTimeout, o.serverWriteTimeout, o.serverIdleTimeout
+	if readTimeout <= 0 {
+		readTimeout = defaultServerReadTimeout
+	}
+	if writeTimeout <= 0 {
+		writeTimeout = defaultServerWriteTimeout
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = defaultServerIdleTimeout
 	}
 	srv := &httptest.Server{
 		Listener: l,
-		Config:   &http.Server{Handler: o},
+		Config: &http.Server{
+			Handler:      o,
+			ReadTimeout:  readTimeout,
+			WriteTimeout: writeTimeout,
+			IdleTimeout:  idleTimeout,
+		},
 	}
 	srv.Start()
 
-	// Update server url to use for example http://localhost:port
-	if host != "127.0.0.1" {
-		_, p, err := net.SplitHostPort(l.Addr().String())
-		if err != nil {
-			return nil, errors.Wrapf(err, "error parsing %s", l.Addr().String())
+	// Update server url to use the IP literal the server is listening on,
+	// even if the listen address uses a name like localhost, or the host in
+	// --loopback-redirect-host.
+	srv.URL = "http://" + net.JoinHostPort(o.loopbackHost(addr.IP.String()), strconv.Itoa(addr.Port))
+
+	return srv, nil
+}
+
+// waitReady waits up to the given timeout until the server listening on addr
+// accepts connections. The probe only opens a TCP connection, so it does not
+// count as an invalid request on the callback url.
+func waitReady(addr net.Addr, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = defaultReadyTimeout
+	}
+	host := addr.String()
+	if a, ok := addr.(*net.TCPAddr); ok && (a.IP == nil || a.IP.IsUnspecified()) {
+		host = net.JoinHostPort("127.0.0.1", strconv.Itoa(a.Port))
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", host, timeout)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Wrapf(err, "error waiting for the callback server on %s", host)
 		}
-		srv.URL = "http://" + host + ":" + p
+		time.Sleep(50 * time.Millisecond)
 	}
+}
 
-	return srv, nil
+// loopbackHost returns the host to use in the loopback redirect_uri. It
+// returns the value of --loopback-redirect-host if set, or the given listen
+// host otherwise.
+//
+// As recommended in RFC 8252, section 8.3, a loopback IP literal is used
+// instead of localhost, so the redirect does not depend on the local name
+// resolution or on a firewall allowing the name.
+func (o *oauth) loopbackHost(host string) string {
+	if o.redirectHost != "" {
+		return o.redirectHost
+	}
+	if host == "" || host == "localhost" {
+		return "127.0.0.1"
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return "127.0.0.1"
+	}
+	return host
 }
 
+// openInBrowser opens the given url in the browser, it is replaced in the
+// tests.
+var openInBrowser = exec.OpenInBrowser
+
 // DoLoopbackAuthorization performs the log in into the identity provider
 // opening a browser and using a redirect_uri in a loopback IP address
 // (http://127.0.0.1:port or http://[::1]:port).
@@ -601,6 +2588,12 @@ func (o *oauth) DoLoopbackAuthorization() (*token, error) {
 		o.redirectURI = srv.URL
 	}
 	defer srv.Close()
+	defer close(o.done)
+
+	// Make sure the first callback is not refused in slow environments.
+	if err := waitReady(srv.Listener.Addr(), o.readyTimeout); err != nil {
+		return nil, err
+	}
 
 	// Get auth url and open it in a browser
 	authURL, err := o.Auth()
@@ -608,7 +2601,10 @@ func (o *oauth) DoLoopbackAuthorization() (*token, error) {
 		return nil, err
 	}
 
-	if err := exec.OpenInBrowser(authURL, o.browser); err != nil {
+	if err := openInBrowser(authURL, o.browser); err != nil {
+		if o.failIfNoBrowser {
+			return nil, errors.Wrap(err, "cannot open a web browser")
+		}
 		fmt.Fprintln(os.Stderr, "Cannot open a web browser on your platform.")
 		fmt.Fprintln(os.Stderr)
 		fmt.Fprintln(os.Stderr, "Open a local web browser and visit:")
@@ -622,14 +2618,188 @@ func (o *oauth) DoLoopbackAuthorization() (*token, error) {
 		fmt.Fprintln(os.Stderr)
 	}
 
-	// Wait for response and return the token
+	// Wait for response and return the token. The time spent in the token
+	// exchange does not count against the time given to the browser.
+	browserTimeout, exchangeTimeout := o.browserTimeout, o.exchangeTimeout
+	if browserTimeout <= 0 {
+		browserTimeout = defaultBrowserTimeout
+	}
+	if exchangeTimeout <= 0 {
+		exchangeTimeout = defaultExchangeTimeout
+	}
+	timer := time.NewTimer(browserTimeout)
+	defer timer.Stop()
+	codeCh := o.codeCh
+	for {
+		select {
+		case tok := <-o.tokCh:
+			o.mu.Lock()
+			if o.invalidRequests > 0 {
+				fmt.Fprintf(os.Stderr, "Ignored %d invalid request(s) received on the callback url\n", o.invalidRequests)
+			}
+			o.mu.Unlock()
+			return tok, nil
+		case err := <-o.errCh:
+			return nil, err
+		case <-codeCh:
+			codeCh = nil
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(exchangeTimeout)
+		case <-timer.C:
+			if codeCh == nil {
+				return nil, errors.New("oauth command timed out exchanging the authorization code, please try again")
+			}
+			return nil, errors.New("oauth command timed out, please try again")
+		}
+	}
+}
+
+// DoServe keeps the callback server running and performs a new authorization
+// every time the authorize path is visited. The tokens are passed to emit as
+// they are received. DoServe only returns if the server cannot be started or
+// emit fails.
+func (o *oauth) DoServe(emit func(*roundToken) error) error {
+	srv, err := o.NewServer()
+	if err != nil {
+		return err
+	}
+	if o.CallbackListenerURL != "" {
+		o.redirectURI = o.CallbackListenerURL
+	} else {
+		o.redirectURI = srv.URL
+	}
+	defer srv.Close()
+	defer close(o.done)
+
+	u, err := url.Parse(o.redirectURI)
+	if err != nil {
+		return errors.Wrapf(err, "error parsing %s", o.redirectURI)
+	}
+	u.Path = o.authorizePath()
+	u.RawQuery = ""
+
+	fmt.Fprintln(os.Stderr, "Visit the following URL to start a new authorization:")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, u.String())
+	fmt.Fprintln(os.Stderr)
+
+	for {
+		select {
+		case rt := <-o.roundCh:
+			if err := emit(rt); err != nil {
+				return err
+			}
+		case err := <-o.errCh:
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// isCallback returns true if the request is sent to the callback url. If the
+// url in --listen-url has a query string, the request must contain the same
+// parameters, as providers append the code and state to them.
+func (o *oauth) isCallback(req *http.Request) bool {
+	if req.URL.Path != o.CallbackPath {
+		return false
+	}
+	if o.CallbackListenerURL == "" {
+		return true
+	}
+	u, err := url.Parse(o.CallbackListenerURL)
+	if err != nil {
+		return false
+	}
+	q := req.URL.Query()
+	for k, values := range u.Query() {
+		if len(q[k]) < len(values) {
+			return false
+		}
+		for i, v := range values {
+			if q[k][i] != v {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// authorizePath returns the path that starts a new authorization in serve
+// mode.
+func (o *oauth) authorizePath() string {
+	return path.Join(o.CallbackPath, "authorize")
+}
+
+// serveRound is an authorization round started in serve mode. Rounds are
+// identified by their state, so several rounds can be in flight.
+type serveRound struct {
+	id            int
+	state         string
+	codeChallenge string
+	nonce         string
+	scope         string
+	started       time.Time
+}
+
+// roundToken is the token of a round in serve mode, it is printed as a JSON
+// line with the round number and the requested scope.
+type roundToken struct {
+	Round          int    `json:"round"`
+	RequestedScope string `json:"requested_scope"`
+	*token
+}
+
+// authorizeHandler starts a new authorization round in serve mode, generating
+// a new state, code verifier, and nonce, and redirecting the browser to the
+// authorization endpoint. The configured scope is used unless the request has
+// a scope query parameter. Rounds not completed within the browser timeout are
+// discarded. It must be called with o.mu held.
+func (o *oauth) authorizeHandler(w http.ResponseWriter, req *http.Request) {
+	state, challenge, nonce, err := newSecrets(o.entropy)
+	if err != nil {
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+	scope := o.scope
+	if s := req.URL.Query().Get("scope"); s != "" {
+		scope = s
+	}
+
+	authURL, err := o.authURL(state, challenge, nonce, scope)
+	if err != nil {
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	browserTimeout := o.browserTimeout
+	if browserTimeout <= 0 {
+		browserTimeout = defaultBrowserTimeout
+	}
+	now := time.Now()
+	for k, r := range o.rounds {
+		if now.Sub(r.started) > browserTimeout {
+			delete(o.rounds, k)
+		}
+	}
+	o.lastRound++
+	o.rounds[state] = &serveRound{
+		id:            o.lastRound,
+		state:         state,
+		codeChallenge: challenge,
+		nonce:         nonce,
+		scope:         scope,
+		started:       now,
+	}
+	fmt.Fprintf(os.Stderr, "Started authorization round %d with scope %q\n", o.lastRound, scope)
+	http.Redirect(w, req, authURL, http.StatusFound)
+}
+
+// sendRoundToken sends the token of a round to DoServe.
+func (o *oauth) sendRoundToken(rt *roundToken) {
 	select {
-	case tok := <-o.tokCh:
-		return tok, nil
-	case err := <-o.errCh:
-		return nil, err
-	case <-time.After(2 * time.Minute):
-		return nil, errors.New("oauth command timed out, please try again")
+	case o.roundCh <- rt:
+	case <-o.done:
 	}
 }
 
@@ -637,7 +2807,7 @@ func (o *oauth) DoLoopbackAuthorization() (*token, error) {
 // allowing the user to open a browser on a different system and then entering
 // the authorization code on the Step CLI.
 func (o *oauth) DoManualAuthorization() (*token, error) {
-	o.redirectURI = oobCallbackUrn
+	o.redirectURI = o.oobRedirectURI()
 	authURL, err := o.Auth()
 	if err != nil {
 		return nil, err
@@ -649,12 +2819,22 @@ func (o *oauth) DoManualAuthorization() (*token, error) {
 	fmt.Fprintln(os.Stderr)
 
 	// Read from the command line
-	fmt.Fprint(os.Stderr, "Enter verification code: ")
-	code, err := utils.ReadString(os.Stdin)
+	fmt.Fprint(os.Stderr, "Enter verification code or the url the browser was redirected to: ")
+	input, err := utils.ReadString(os.Stdin)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
+	// Some providers display the state along with the code, if they do, make
+	// sure that the code belongs to this authorization request.
+	code, state := parseVerificationCode(input)
+	if code == "" {
+		return nil, errors.New("invalid verification code: missing code")
+	}
+	if state != "" && !o.noState && state != o.state {
+		return nil, errors.New("invalid verification code: the state does not match the authorization request")
+	}
+
 	tok, err := o.Exchange(o.tokenEndpoint, code)
 	if err != nil {
 		return nil, err
@@ -665,81 +2845,220 @@ func (o *oauth) DoManualAuthorization() (*token, error) {
 	return tok, nil
 }
 
-// DoTwoLeggedAuthorization performs two-legged OAuth using the jwt-bearer
-// grant type.
-func (o *oauth) DoTwoLeggedAuthorization(issuer string) (*token, error) {
-	pemBytes := []byte(o.clientSecret)
-	block, _ := pem.Decode(pemBytes)
-	if block == nil {
-		return nil, fmt.Errorf("failed to read private key pem block")
+// oobRedirectURI returns the redirect_uri used in the console flow, the value
+// of --console-redirect-url or the out-of-band URN.
+func (o *oauth) oobRedirectURI() string {
+	if o.consoleRedirectURI != "" {
+		return o.consoleRedirectURI
 	}
-	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	return oobCallbackUrn
+}
+
+// DoCodeExchange exchanges an authorization code obtained elsewhere for a
+// token, without opening a browser or starting a server. The redirect_uri sent
+// is the one in --listen-url, and it must match the one used to get the code.
+func (o *oauth) DoCodeExchange(code, verifier string) (*token, error) {
+	o.redirectURI = o.CallbackListenerURL
+	o.codeChallenge = verifier
+
+	tok, err := o.Exchange(o.tokenEndpoint, code)
 	if err != nil {
-		return nil, errors.Wrap(err, "error parsing private key")
+		return nil, err
+	}
+	if tok.Err != "" || tok.ErrDesc != "" {
+		return nil, errors.Errorf("Error exchanging authorization code: %s. %s", tok.Err, tok.ErrDesc)
 	}
+	return tok, nil
+}
 
-	// Add claims
-	now := int(time.Now().Unix())
-	c := map[string]interface{}{
-		"aud":   o.tokenEndpoint,
-		"nbf":   now,
-		"iat":   now,
-		"exp":   now + 3600,
-		"iss":   issuer,
-		"scope": o.scope,
+// DoRefreshToken gets a new token using the refresh_token grant. The scope is
+// optional, and if set it must not include scopes not originally granted. The
+// given refresh token is returned if the provider does not rotate it.
+func (o *oauth) DoRefreshToken(refreshToken, scope string) (*token, error) {
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("refresh_token", refreshToken)
+	data.Set("client_id", o.clientID)
+	if o.clientSecret != "" {
+		data.Set("client_secret", o.clientSecret)
+	}
+	if scope != "" {
+		data.Set("scope", scope)
 	}
 
-	so := new(jose.SignerOptions)
-	so.WithType("JWT")
-	so.WithHeader("kid", o.clientID)
+	t := time.Now()
+	resp, err := o.postForm(o.tokenEndpoint, data)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	o.recordExchange(time.Since(t))
 
-	// Sign JWT
-	signer, err := jose.NewSigner(jose.SigningKey{
-		Algorithm: "RS256",
-		Key:       priv,
-	}, so)
+	tok, err := o.decodeToken(resp.Body)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error creating JWT signer")
+		return nil, err
 	}
+	if tok.Err == "invalid_grant" {
+		return nil, &invalidGrantError{ErrDesc: tok.ErrDesc}
+	}
+	if tok.Err != "" || tok.ErrDesc != "" {
+		return nil, errors.Errorf("Error refreshing token: %s. %s", tok.Err, tok.ErrDesc)
+	}
+	if tok.RefreshToken == "" {
+		tok.RefreshToken = refreshToken
+	}
+	return tok, nil
+}
+
+// parseVerificationCode returns the code and state in the value entered in the
+// console flow. The value can be just the code, a query string like
+// "code=<code>&state=<state>" if the provider displays both, or the full url
+// the browser was redirected to, e.g. if --console-redirect-url is a localhost
+// url without a server. The code is empty if the url does not have one.
+func parseVerificationCode(s string) (code, state string) {
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return "", ""
+		}
+		q := u.Query()
+		return q.Get("code"), q.Get("state")
+	}
+	s = strings.TrimPrefix(s, "?")
+	if !strings.Contains(s, "code=") {
+		return s, ""
+	}
+	q, err := url.ParseQuery(s)
+	if err != nil || q.Get("code") == "" {
+		return s, ""
+	}
+	return q.Get("code"), q.Get("state")
+}
 
-	raw, err := jose.Signed(signer).Claims(c).CompactSerialize()
+// DoTwoLeggedAuthorization performs two-legged OAuth using the jwt-bearer
+// grant type.
+func (o *oauth) DoTwoLeggedAuthorization(issuer string) (*token, error) {
+	raw, err := o.twoLeggedAssertion(issuer)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error serializing JWT")
+		return nil, err
 	}
 
 	// Construct the POST request to fetch the OAuth token.
 	params := url.Values{
-		"assertion":  []string{string(raw)},
+		"assertion":  []string{raw},
 		"grant_type": []string{jwtBearerUrn},
 	}
+	var username, password string
+	switch o.tokenAuthMethod {
+	case tokenAuthPost:
+		params.Set("client_id", o.tokenAuthClientID)
+		params.Set("client_secret", o.tokenAuthSecret)
+	case tokenAuthBasic:
+		username, password = o.tokenAuthClientID, o.tokenAuthSecret
+	}
 
 	// Send the POST request and return token.
-	resp, err := http.PostForm(o.tokenEndpoint, params)
+	t := time.Now()
+	resp, err := o.postFormWithBasicAuth(o.tokenEndpoint, params, username, password)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error from token endpoint")
 	}
 	defer resp.Body.Close()
+	o.recordExchange(time.Since(t))
 
-	var tok token
-	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
-		return nil, errors.WithStack(err)
+	return o.decodeToken(resp.Body)
+}
+
+// DoClientCredentialsAuthorization gets a token for the client using the
+// client_credentials grant type. The client is authenticated with the method in
+// --token-auth-method, client_secret_post by default. The space-delimited scope
+// is only sent if it is not empty.
+func (o *oauth) DoClientCredentialsAuthorization(scope string) (*token, error) {
+	params := url.Values{
+		"grant_type": []string{"client_credentials"},
+	}
+	if scope != "" {
+		params.Set("scope", scope)
+	}
+	var username, password string
+	if o.tokenAuthMethod == tokenAuthBasic {
+		username, password = o.clientID, o.clientSecret
+	} else {
+		params.Set("client_id", o.clientID)
+		params.Set("client_secret", o.clientSecret)
+	}
+
+	t := time.Now()
+	resp, err := o.postFormWithBasicAuth(o.tokenEndpoint, params, username, password)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error from token endpoint")
 	}
+	defer resp.Body.Close()
+	o.recordExchange(time.Since(t))
 
-	return &tok, nil
+	tok, err := o.decodeToken(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if tok.Err != "" || tok.ErrDesc != "" {
+		return nil, errors.Errorf("Error requesting client credentials token: %s. %s", tok.Err, tok.ErrDesc)
+	}
+	return tok, nil
 }
 
-// DoJWTAuthorization generates a JWT instead of an OAuth token. Only works for
-// certain APIs. See https://developers.google.com/identity/protocols/OAuth2ServiceAccount#jwt-auth.
-func (o *oauth) DoJWTAuthorization(issuer, aud string) (*token, error) {
-	pemBytes := []byte(o.clientSecret)
-	block, _ := pem.Decode(pemBytes)
+// parsePrivateKey parses the PKCS #8 PEM encoded private key of a service
+// account.
+func parsePrivateKey(s string) (interface{}, error) {
+	block, _ := pem.Decode([]byte(s))
 	if block == nil {
-		return nil, fmt.Errorf("failed to read private key pem block")
+		return nil, errors.New("failed to read private key pem block")
 	}
 	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
 	if err != nil {
 		return nil, errors.Wrap(err, "error parsing private key")
 	}
+	return priv, nil
+}
+
+// assertionKey returns the key that signs the JWT of a service account, the
+// key in --assertion-key or the private key of the account.
+func (o *oauth) assertionKey() (interface{}, error) {
+	if o.assertionSigner != nil {
+		return o.assertionSigner, nil
+	}
+	return parsePrivateKey(o.clientSecret)
+}
+
+// twoLeggedAssertion returns the signed JWT sent as the assertion in the
+// jwt-bearer grant type.
+func (o *oauth) twoLeggedAssertion(issuer string) (string, error) {
+	priv, err := o.assertionKey()
+	if err != nil {
+		return "", err
+	}
+
+	// Add claims
+	now := int(time.Now().Unix())
+	c := map[string]interface{}{
+		"aud":   o.tokenEndpoint,
+		"nbf":   now,
+		"iat":   now,
+		"exp":   now + 3600,
+		"iss":   issuer,
+		"scope": o.scope,
+	}
+
+	// Sign JWT
+	return signJWT("RS256", priv, o.clientID, c)
+}
+
+// DoJWTAuthorization generates a JWT instead of an OAuth token. Only works for
+// certain APIs. See https://developers.google.com/identity/protocols/OAuth2ServiceAccount#jwt-auth.
+func (o *oauth) DoJWTAuthorization(issuer, aud string) (*token, error) {
+	priv, err := o.assertionKey()
+	if err != nil {
+		return nil, err
+	}
 
 	// Add claims
 	now := int(time.Now().Unix())
@@ -752,67 +3071,54 @@ func (o *oauth) DoJWTAuthorization(issuer, aud string) (*token, error) {
 		"sub": issuer,
 	}
 
-	so := new(jose.SignerOptions)
-	so.WithType("JWT")
-	so.WithHeader("kid", o.clientID)
-
 	// Sign JWT
-	signer, err := jose.NewSigner(jose.SigningKey{
-		Algorithm: "RS256",
-		Key:       priv,
-	}, so)
+	raw, err := signJWT("RS256", priv, o.clientID, c)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error creating JWT signer")
+		return nil, err
 	}
 
-	raw, err := jose.Signed(signer).Claims(c).CompactSerialize()
-	if err != nil {
-		return nil, errors.Wrapf(err, "error serializing JWT")
+	tok := &token{
+		AccessToken: string(raw),
+		ExpiresIn:   3600,
+		TokenType:   "Bearer",
 	}
-
-	tok := &token{string(raw), "", "", 3600, "Bearer", "", ""}
 	return tok, nil
 }
 
 // ServeHTTP is the handler that performs the OAuth 2.0 dance and returns the
 // tokens using channels.
 func (o *oauth) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if req.URL.Path != o.CallbackPath {
-		http.NotFound(w, req)
+	// The error is sent without holding the lock, so the other requests are
+	// not blocked while the flow is busy, for example writing a token in serve
+	// mode.
+	cr, err := o.callback(w, req)
+	switch {
+	case err != nil:
+		o.sendError(err)
 		return
-	}
-
-	q := req.URL.Query()
-	errStr := q.Get("error")
-	if errStr != "" {
-		o.badRequest(w, "Failed to authenticate: "+errStr)
+	case cr == nil:
 		return
-	}
-
-	if o.implicit {
+	case cr.implicit:
 		o.implicitHandler(w, req)
 		return
 	}
+	code, verifier, round := cr.code, cr.verifier, cr.round
+
+	// The exchange is canceled if the flow returns, for example after the
+	// exchange timeout, so the server can be closed without waiting for it.
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-o.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	code, state := q.Get("code"), q.Get("state")
-	if code == "" || state == "" {
-		fmt.Fprintf(os.Stderr, "Invalid request received: http://%s%s\n", req.RemoteAddr, req.URL.String())
-		fmt.Fprintf(os.Stderr, "You may have an app or browser plugin that needs to be turned off\n")
-		http.Error(w, "400 bad request", http.StatusBadRequest)
-		return
-	}
-
-	if code == "" {
-		o.badRequest(w, "Failed to authenticate: missing or invalid code")
-		return
-	}
-
-	if state == "" || state != o.state {
-		o.badRequest(w, "Failed to authenticate: missing or invalid state")
-		return
-	}
-
-	tok, err := o.Exchange(o.tokenEndpoint, code)
+	// The lock is not held during the exchange, so other requests, like the
+	// ones sent by prefetchers, are not blocked by a slow token endpoint.
+	tok, err := o.exchange(ctx, o.tokenEndpoint, code, verifier)
 	if err != nil {
 		o.badRequest(w, "Failed exchanging authorization code: "+err.Error())
 		return
@@ -827,14 +3133,126 @@ func (o *oauth) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	} else {
 		o.success(w)
 	}
-	o.tokCh <- tok
+	if round != nil {
+		o.sendRoundToken(&roundToken{Round: round.id, RequestedScope: round.scope, token: tok})
+		return
+	}
+	o.sendToken(tok)
 }
 
-func (o *oauth) implicitHandler(w http.ResponseWriter, req *http.Request) {
+// callbackRequest is a valid request to the callback url.
+type callbackRequest struct {
+	code     string
+	verifier string
+	round    *serveRound // Only set in serve mode
+	implicit bool
+}
+
+// callback handles the requests to the local server holding o.mu. It returns
+// the authorization code and the PKCE code verifier to exchange if the request
+// is a valid callback, otherwise it responds to the request, and returns the
+// error to send to the flow, if any.
+func (o *oauth) callback(w http.ResponseWriter, req *http.Request) (*callbackRequest, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.serve && req.URL.Path == o.authorizePath() {
+		o.authorizeHandler(w, req)
+		return nil, nil
+	}
+
+	if !o.isCallback(req) {
+		// Browsers request the icons on their own, do not report them.
+		if browserAssets[req.URL.Path] {
+			w.WriteHeader(http.StatusNoContent)
+			return nil, nil
+		}
+		http.NotFound(w, req)
+		return nil, nil
+	}
+
+	if !o.allowsMethod(req.Method) {
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return nil, nil
+	}
+
 	q := req.URL.Query()
+	if req.Method == http.MethodPost {
+		if err := req.ParseForm(); err != nil {
+			http.Error(w, "400 bad request", http.StatusBadRequest)
+			return nil, nil
+		}
+		q = req.Form
+	}
+	errStr := q.Get("error")
+	if interactionRequiredErrors[errStr] && o.prompt == "none" {
+		err := &interactionRequiredError{Err: errStr, ErrDesc: q.Get("error_description")}
+		o.writeBadRequest(w, err.Error())
+		return nil, err
+	}
+	if errStr != "" {
+		msg := "Failed to authenticate: " + errStr
+		o.writeBadRequest(w, msg)
+		return nil, errors.New(msg)
+	}
+
+	if o.implicit {
+		return &callbackRequest{implicit: true}, nil
+	}
+
+	code, state := strings.TrimSpace(q.Get("code")), strings.TrimSpace(q.Get("state"))
+	if _, found := q["code"]; found && code == "" {
+		msg := "Failed to authenticate: empty authorization code"
+		o.writeBadRequest(w, msg)
+		return nil, errors.New(msg)
+	}
+	if code == "" && q.Get("urlhash") == "" {
+		// Some providers send the errors in the fragment even if the code
+		// flow is used, send them back to detect them.
+		o.fragmentRedirect(w, "Processing")
+		return nil, nil
+	}
+	if code == "" || (state == "" && !o.noState) {
+		o.invalidRequest(w, req)
+		return nil, nil
+	}
+
+	// Requests with an unknown state are ignored, they do not belong to this
+	// authorization. Each authorization can only be completed once.
+	cr := &callbackRequest{code: code, verifier: o.codeChallenge}
+	if o.serve {
+		if cr.round = o.rounds[state]; cr.round == nil {
+			o.invalidRequest(w, req)
+			return nil, nil
+		}
+		delete(o.rounds, state)
+		cr.verifier = cr.round.codeChallenge
+	} else {
+		if o.codeReceived || (!o.noState && state != o.state) {
+			o.invalidRequest(w, req)
+			return nil, nil
+		}
+		o.codeReceived = true
+	}
+
+	// Start the exchange timeout.
+	select {
+	case o.codeCh <- struct{}{}:
+	default:
+	}
+
+	return cr, nil
+}
+
+func (o *oauth) implicitHandler(w http.ResponseWriter, req *http.Request) {
+	q, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		o.badRequest(w, "Failed to authenticate: malformed response")
+		return
+	}
 	if hash := q.Get("urlhash"); hash == "true" {
 		state := q.Get("state")
-		if state == "" || state != o.state {
+		if !o.noState && (state == "" || state != o.state) {
 			o.badRequest(w, "Failed to authenticate: missing or invalid state")
 			return
 		}
@@ -843,6 +3261,19 @@ func (o *oauth) implicitHandler(w http.ResponseWriter, req *http.Request) {
 			o.badRequest(w, "Failed to authenticate: missing access token")
 			return
 		}
+		for _, k := range []string{"access_token", "id_token", "refresh_token", "token_type"} {
+			if !isTokenValue(q.Get(k)) {
+				o.badRequest(w, "Failed to authenticate: invalid "+k)
+				return
+			}
+		}
+		var expiresIn int
+		if v := q.Get("expires_in"); v != "" {
+			if expiresIn, err = strconv.Atoi(v); err != nil || expiresIn < 0 {
+				o.badRequest(w, "Failed to authenticate: invalid expires_in")
+				return
+			}
+		}
 
 		if o.terminalRedirect != "" {
 			http.Redirect(w, req, o.terminalRedirect, 302)
@@ -850,33 +3281,60 @@ func (o *oauth) implicitHandler(w http.ResponseWriter, req *http.Request) {
 			o.success(w)
 		}
 
-		expiresIn, _ := strconv.Atoi(q.Get("expires_in"))
-		o.tokCh <- &token{
+		o.sendToken(&token{
 			AccessToken:  accessToken,
 			IDToken:      q.Get("id_token"),
 			RefreshToken: q.Get("refresh_token"),
 			ExpiresIn:    expiresIn,
-			TokenType:    q.Get("token_type"),
-		}
+			TokenType:    normalizeTokenType(q.Get("token_type")),
+		})
 		return
 	}
 
+	o.fragmentRedirect(w, "Success")
+}
+
+// fragmentRedirect writes a page that sends the parameters in the url fragment
+// back to the callback url as query parameters, adding urlhash=true. The
+// fragment is never sent to the server by the browser.
+func (o *oauth) fragmentRedirect(w http.ResponseWriter, heading string) {
 	w.WriteHeader(http.StatusOK)
 	w.Header().Add("Content-Type", "text/html; charset=utf-8")
 	w.Write([]byte(`<html><head><title>Processing OAuth Request</title>`))
 	w.Write([]byte(`</head>`))
 	w.Write([]byte(`<script type="text/javascript">`))
-	w.Write([]byte(fmt.Sprintf(`function redirect(){var hash = window.location.hash.substr(1); document.location.href = "%s?urlhash=true&"+hash;}`, o.redirectURI)))
+	// Redirect to the current path, so the fragment is always sent back to
+	// this server and never to a different origin.
+	w.Write([]byte(`function redirect(){var hash = window.location.hash.substr(1); var search = window.location.search; document.location.href = window.location.pathname + (search ? search + "&" : "?") + "urlhash=true&"+hash;}`))
 	w.Write([]byte(`if (window.addEventListener) window.addEventListener("load", redirect, false); else if (window.attachEvent) window.attachEvent("onload", redirect); else window.onload = redirect;`))
 	w.Write([]byte("</script>"))
 	w.Write([]byte(`<body><p style='font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif, "Apple Color Emoji", "Segoe UI Emoji", "Segoe UI Symbol"; font-size: 22px; color: #333; width: 400px; margin: 0 auto; text-align: center; line-height: 1.7; padding: 20px;'>`))
-	w.Write([]byte(`<strong style='font-size: 28px; color: #000;'>Success</strong><br />`))
+	w.Write([]byte(`<strong style='font-size: 28px; color: #000;'>` + heading + `</strong><br />`))
 	w.Write([]byte(`Click <a href="javascript:redirect();">here</a> if your browser does not automatically redirect you`))
 	w.Write([]byte(`</p></body></html>`))
 }
 
-// Auth returns the OAuth 2.0 authentication url.
+// isTokenValue returns true if s only contains the visible ASCII characters
+// allowed in the token values of an OAuth 2.0 response.
+func isTokenValue(s string) bool {
+	for _, c := range s {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// Auth returns the OAuth 2.0 authentication url. If AuthURLHook is set, it
+// is called with the url before it is returned, so callers can add or sign
+// parameters before the browser opens.
 func (o *oauth) Auth() (string, error) {
+	return o.authURL(o.state, o.codeChallenge, o.nonce, o.scope)
+}
+
+// authURL returns the authentication url using the given state, code
+// verifier, nonce, and scope.
+func (o *oauth) authURL(state, verifier, nonce, scope string) (string, error) {
 	u, err := url.Parse(o.authzEndpoint)
 	if err != nil {
 		return "", errors.WithStack(err)
@@ -890,44 +3348,134 @@ func (o *oauth) Auth() (string, error) {
 	} else {
 		q.Add("response_type", "code")
 		q.Add("code_challenge_method", "S256")
-		s256 := sha256.Sum256([]byte(o.codeChallenge))
+		s256 := sha256.Sum256([]byte(verifier))
 		q.Add("code_challenge", base64.RawURLEncoding.EncodeToString(s256[:]))
 	}
-	q.Add("scope", o.scope)
+	q.Add("scope", scope)
 	if o.prompt != "" {
 		q.Add("prompt", o.prompt)
 	}
-	q.Add("state", o.state)
-	q.Add("nonce", o.nonce)
+	// Google only issues a new refresh token with offline access.
+	if o.forceConsent && strings.HasPrefix(o.authzEndpoint, "https://accounts.google.com/") {
+		q.Add("access_type", "offline")
+	}
+	if !o.noState {
+		q.Add("state", state)
+	}
+	// The nonce is an OpenID Connect parameter, the implicit flow always
+	// requests an ID token.
+	if o.sendNonce || o.implicit || hasScope(scope, "openid") {
+		q.Add("nonce", nonce)
+	}
+	if o.claimsRequest != "" {
+		q.Add("claims", o.claimsRequest)
+	}
 	if o.loginHint != "" {
 		q.Add("login_hint", o.loginHint)
 	}
+	if o.audience != "" {
+		q.Add("audience", o.audience)
+	}
 	u.RawQuery = q.Encode()
-	return u.String(), nil
+	if o.AuthURLHook != nil {
+		if err := o.AuthURLHook(u); err != nil {
+			return "", errors.Wrap(err, "error modifying the authorization url")
+		}
+	}
+
+	authURL := u.String()
+	if len(authURL) > maxAuthURLLength {
+		warnf("the authorization url has %d characters and it might be rejected by the provider or the browser; "+
+			"request fewer scopes or use pushed authorization requests (RFC 9126) if the provider supports them", len(authURL))
+	}
+	return authURL, nil
 }
 
 // Exchange exchanges the authorization code for refresh and access tokens.
 func (o *oauth) Exchange(tokenEndpoint, code string) (*token, error) {
+	return o.exchange(context.Background(), tokenEndpoint, code, o.codeChallenge)
+}
+
+// exchange exchanges the authorization code using the given PKCE code
+// verifier. The request is canceled if the given context is done.
+func (o *oauth) exchange(ctx context.Context, tokenEndpoint, code, verifier string) (*token, error) {
 	data := url.Values{}
 	data.Set("code", code)
 	data.Set("client_id", o.clientID)
-	data.Set("client_secret", o.clientSecret)
-	data.Set("redirect_uri", o.redirectURI)
+	// Public clients do not have a secret, some providers reject an empty one.
+	if o.clientSecret != "" {
+		data.Set("client_secret", o.clientSecret)
+	}
+	// The redirect_uri must match the one in the authorize request, unless a
+	// proxy rewrites it.
+	if o.exchangeRedirectURI != "" {
+		data.Set("redirect_uri", o.exchangeRedirectURI)
+	} else {
+		data.Set("redirect_uri", o.redirectURI)
+	}
 	data.Set("grant_type", "authorization_code")
-	data.Set("code_verifier", o.codeChallenge)
+	if verifier != "" {
+		data.Set("code_verifier", verifier)
+	}
 
-	resp, err := http.PostForm(tokenEndpoint, data)
+	t := time.Now()
+	resp, err := o.postFormContext(ctx, tokenEndpoint, data, "", "")
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 	defer resp.Body.Close()
+	o.recordExchange(time.Since(t))
 
-	var tok token
-	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
-		return nil, errors.WithStack(err)
-	}
+	return o.decodeToken(resp.Body)
+}
+
+// postForm sends the data to the given token endpoint. If the connection
+// fails, the request is sent to the next endpoint set in --token-endpoint.
+func (o *oauth) postForm(tokenEndpoint string, data url.Values) (*http.Response, error) {
+	return o.postFormContext(context.Background(), tokenEndpoint, data, "", "")
+}
+
+// postFormWithBasicAuth is like postForm, but it also authenticates the client
+// using the HTTP Basic authentication scheme if username is not empty. As
+// defined in RFC 6749, section 2.3.1, the credentials are form-encoded first.
+func (o *oauth) postFormWithBasicAuth(tokenEndpoint string, data url.Values, username, password string) (*http.Response, error) {
+	return o.postFormContext(context.Background(), tokenEndpoint, data, username, password)
+}
 
-	return &tok, nil
+// postFormContext is like postFormWithBasicAuth, but the requests are canceled
+// if the given context is done.
+func (o *oauth) postFormContext(ctx context.Context, tokenEndpoint string, data url.Values, username, password string) (*http.Response, error) {
+	if len(o.tokenParams) > 0 {
+		params := url.Values{}
+		for k, v := range data {
+			params[k] = v
+		}
+		for k, v := range o.tokenParams {
+			if _, ok := params[k]; !ok {
+				params[k] = v
+			}
+		}
+		data = params
+	}
+	post := func(u string) (*http.Response, error) {
+		return withRetry(func() (*http.Response, error) {
+			req, err := http.NewRequestWithContext(ctx, "POST", u, strings.NewReader(data.Encode()))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if username != "" {
+				req.SetBasicAuth(url.QueryEscape(username), url.QueryEscape(password))
+			}
+			return httpClient.Do(req)
+		})
+	}
+	resp, err := post(tokenEndpoint)
+	for i := 0; err != nil && i < len(o.tokenEndpoints); i++ {
+		warnf("%v, trying %s", err, o.tokenEndpoints[i])
+		resp, err = post(o.tokenEndpoints[i])
+	}
+	return resp, err
 }
 
 func (o *oauth) success(w http.ResponseWriter) {
@@ -940,6 +3488,28 @@ func (o *oauth) success(w http.ResponseWriter) {
 }
 
 func (o *oauth) badRequest(w http.ResponseWriter, msg string) {
+	o.badRequestWithError(w, msg, errors.New(msg))
+}
+
+// badRequestWithError responds with the given message, and sends the given
+// error to the running flow.
+func (o *oauth) badRequestWithError(w http.ResponseWriter, msg string, err error) {
+	o.writeBadRequest(w, msg)
+	o.sendError(err)
+}
+
+// writeBadRequest responds with the given message, or redirects to the
+// --error-redirect-url with it.
+func (o *oauth) writeBadRequest(w http.ResponseWriter, msg string) {
+	if u, err := url.Parse(o.errorRedirect); err == nil && o.errorRedirect != "" {
+		q := u.Query()
+		q.Set("error_description", msg)
+		u.RawQuery = q.Encode()
+		w.Header().Set("Location", u.String())
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+
 	w.WriteHeader(http.StatusBadRequest)
 	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
 	w.Write([]byte(`<html><head><title>OAuth Request Unsuccessful</title>`))
@@ -947,5 +3517,59 @@ func (o *oauth) badRequest(w http.ResponseWriter, msg string) {
 	w.Write([]byte(`<strong style='font-size: 28px; color: red;'>Failure</strong><br />`))
 	w.Write([]byte(msg))
 	w.Write([]byte(`</p></body></html>`))
-	o.errCh <- errors.New(msg)
+}
+
+// browserAssets are the paths that browsers request automatically.
+var browserAssets = map[string]bool{
+	"/favicon.ico":                      true,
+	"/apple-touch-icon.png":             true,
+	"/apple-touch-icon-precomposed.png": true,
+}
+
+// allowsMethod returns true if the given HTTP method is accepted on the
+// callback url.
+func (o *oauth) allowsMethod(method string) bool {
+	switch o.callbackMethod {
+	case http.MethodGet, http.MethodPost:
+		return method == o.callbackMethod
+	default:
+		return method == http.MethodGet || method == http.MethodPost
+	}
+}
+
+// invalidRequest responds to a request to the callback url without a code or
+// with a missing or unknown state, usually sent by a browser plugin or
+// prefetcher. These requests are logged and counted, but they do not complete
+// the flow. It must be called with o.mu held.
+func (o *oauth) invalidRequest(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprintf(os.Stderr, "Invalid request received: http://%s%s\n", req.RemoteAddr, req.URL.String())
+	fmt.Fprintf(os.Stderr, "You may have an app or browser plugin that needs to be turned off\n")
+	http.Error(w, "400 bad request", http.StatusBadRequest)
+	o.invalidRequests++
+}
+
+// recordExchange records the duration of a token request. The callback
+// handlers in serve mode can run concurrently.
+func (o *oauth) recordExchange(d time.Duration) {
+	o.mu.Lock()
+	o.timings.Exchange = d
+	o.mu.Unlock()
+}
+
+// sendToken sends the token to the flow waiting for it. It does not block if
+// the flow has already returned, for example after a timeout.
+func (o *oauth) sendToken(tok *token) {
+	select {
+	case o.tokCh <- tok:
+	case <-o.done:
+	}
+}
+
+// sendError sends the error to the flow waiting for it. It does not block if
+// the flow has already returned, for example after a timeout.
+func (o *oauth) sendError(err error) {
+	select {
+	case o.errCh <- err:
+	case <-o.done:
+	}
 }
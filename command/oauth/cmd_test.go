@@ -0,0 +1,1738 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/cli/command"
+	"github.com/smallstep/cli/exec"
+	"github.com/smallstep/cli/jose"
+	"github.com/urfave/cli"
+)
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         *options
+		callbackPath string
+		wantErr      bool
+	}{
+		{"ok google", &options{Provider: "google", CallbackPath: "/"}, "/", false},
+		{"ok provider", &options{Provider: "https://example.org", CallbackPath: "/"}, "/", false},
+		{"ok http provider", &options{Provider: "http://localhost:8080", AllowInsecureHTTP: true, CallbackPath: "/"}, "/", false},
+		{"ok listen", &options{Provider: "google", CallbackListener: ":10000", CallbackPath: "/"}, "/", false},
+		{"ok listen-url", &options{Provider: "google", CallbackListenerURL: "http://127.0.0.1:10000", CallbackPath: "/"}, "/", false},
+		{"ok listen-url with path", &options{Provider: "google", CallbackListenerURL: "https://proxy.example.com/oauth/callback", CallbackPath: "/"}, "/oauth/callback", false},
+		{"ok claims-request", &options{Provider: "google", ClaimsRequest: `{"id_token":{"email_verified":{"essential":true}}}`, CallbackPath: "/"}, "/", false},
+		{"ok loopback-redirect-host", &options{Provider: "google", RedirectHost: "localhost", CallbackPath: "/"}, "/", false},
+		{"ok loopback-redirect-host ip", &options{Provider: "google", RedirectHost: "127.0.0.1", CallbackPath: "/"}, "/", false},
+		{"ok entropy", &options{Provider: "google", Entropy: 256, CallbackPath: "/"}, "/", false},
+		{"fail entropy too low", &options{Provider: "google", Entropy: 64, CallbackPath: "/"}, "/", true},
+		{"fail entropy too high", &options{Provider: "google", Entropy: 1024, CallbackPath: "/"}, "/", true},
+		{"fail provider without host", &options{Provider: "https://", CallbackPath: "/"}, "/", true},
+		{"fail provider", &options{Provider: "http://example.org", CallbackPath: "/"}, "/", true},
+		{"fail http provider", &options{Provider: "http://localhost:8080", CallbackPath: "/"}, "/", true},
+		{"fail other provider", &options{Provider: "ftp://localhost:8080", AllowInsecureHTTP: true, CallbackPath: "/"}, "/", true},
+		{"fail listen", &options{Provider: "google", CallbackListener: "10000", CallbackPath: "/"}, "/", true},
+		{"fail listen-url", &options{Provider: "google", CallbackListenerURL: "127.0.0.1:10000", CallbackPath: "/"}, "/", true},
+		{"fail listen-url without scheme", &options{Provider: "google", CallbackListenerURL: "proxy.example.com/oauth/callback", CallbackPath: "/"}, "/", true},
+		{"fail loopback-redirect-host", &options{Provider: "google", RedirectHost: "example.com", CallbackPath: "/"}, "/", true},
+		{"ok callback-method", &options{Provider: "google", CallbackMethod: "post", CallbackPath: "/"}, "/", false},
+		{"fail callback-method", &options{Provider: "google", CallbackMethod: "PUT", CallbackPath: "/"}, "/", true},
+		{"ok exchange-redirect-url", &options{Provider: "google", ExchangeRedirectURL: "https://proxy.example.com/callback", CallbackPath: "/"}, "/", false},
+		{"fail exchange-redirect-url", &options{Provider: "google", ExchangeRedirectURL: "proxy.example.com/callback", CallbackPath: "/"}, "/", true},
+		{"ok token-auth-method", &options{Provider: "google", TokenAuthMethod: "client_secret_basic", CallbackPath: "/"}, "/", false},
+		{"fail token-auth-method", &options{Provider: "google", TokenAuthMethod: "private_key_jwt", CallbackPath: "/"}, "/", true},
+		{"fail claims-request", &options{Provider: "google", ClaimsRequest: `["email"]`, CallbackPath: "/"}, "/", true},
+		{"ok token-response-path", &options{Provider: "google", TokenResponsePath: "data.token", CallbackPath: "/"}, "/", false},
+		{"fail token-response-path", &options{Provider: "google", TokenResponsePath: "data..token", CallbackPath: "/"}, "/", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate()
+			assert.Equals(t, tt.wantErr, err != nil)
+			assert.Equals(t, tt.callbackPath, tt.opts.CallbackPath)
+		})
+	}
+}
+
+func TestOptionsValidateProvider(t *testing.T) {
+	opts := &options{Provider: "https://example.org/tenant//", CallbackPath: "/"}
+	assert.FatalError(t, opts.Validate())
+	assert.Equals(t, "https://example.org/tenant", opts.Provider)
+}
+
+func TestDiscoveryURL(t *testing.T) {
+	want := "https://example.org/.well-known/openid-configuration"
+	wantTenant := "https://example.org/tenant/.well-known/openid-configuration"
+	tests := []struct {
+		provider string
+		want     string
+	}{
+		{"https://example.org", want},
+		{"https://example.org/", want},
+		{"https://example.org//", want},
+		{"https://example.org/.well-known/openid-configuration", want},
+		{"https://example.org/.well-known/openid-configuration/", want},
+		{"https://example.org/tenant", wantTenant},
+		{"https://example.org/tenant/", wantTenant},
+		{"https://example.org/tenant/.well-known/openid-configuration", wantTenant},
+		{"https://example.org/tenant?p=b2c", wantTenant + "?p=b2c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			u, err := discoveryURL(tt.provider)
+			assert.FatalError(t, err)
+			assert.Equals(t, tt.want, u.String())
+		})
+	}
+}
+
+func TestParseVerificationCode(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		code  string
+		state string
+	}{
+		{"code", "4/0AX4XfWh", "4/0AX4XfWh", ""},
+		{"query", "code=4/0AX4XfWh&state=abc", "4/0AX4XfWh", "abc"},
+		{"query with question mark", "?state=abc&code=4%2F0AX4XfWh", "4/0AX4XfWh", "abc"},
+		{"query without state", "code=4/0AX4XfWh", "4/0AX4XfWh", ""},
+		{"query without code", "code=&state=abc", "code=&state=abc", ""},
+		{"url", "http://localhost/callback?code=4%2F0AX4XfWh&state=abc", "4/0AX4XfWh", "abc"},
+		{"url without code", "http://localhost/callback?error=access_denied&state=abc", "", "abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, state := parseVerificationCode(tt.input)
+			assert.Equals(t, tt.code, code)
+			assert.Equals(t, tt.state, state)
+		})
+	}
+}
+
+func TestNewServerRedirectHost(t *testing.T) {
+	tests := []struct {
+		name         string
+		listen       string
+		redirectHost string
+		wantHost     string
+	}{
+		{"default", "", "", "127.0.0.1"},
+		{"listen", "127.0.0.1:0", "", "127.0.0.1"},
+		{"listen localhost", "localhost:0", "", "127.0.0.1"},
+		{"listen all", "0.0.0.0:0", "", "127.0.0.1"},
+		{"redirect host", "", "localhost", "localhost"},
+		{"redirect host with listen", "127.0.0.1:0", "localhost", "localhost"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &oauth{CallbackListener: tt.listen, redirectHost: tt.redirectHost}
+			srv, err := o.NewServer()
+			assert.FatalError(t, err)
+			defer srv.Close()
+
+			u, err := url.Parse(srv.URL)
+			assert.FatalError(t, err)
+			assert.Equals(t, tt.wantHost, u.Hostname())
+			assert.Equals(t, strconv.Itoa(srv.Listener.Addr().(*net.TCPAddr).Port), u.Port())
+		})
+	}
+}
+
+func TestNewServerTimeouts(t *testing.T) {
+	o := &oauth{}
+	srv, err := o.NewServer()
+	assert.FatalError(t, err)
+	srv.Close()
+	assert.Equals(t, defaultServerReadTimeout, srv.Config.ReadTimeout)
+	assert.Equals(t, defaultServerWriteTimeout, srv.Config.WriteTimeout)
+	assert.Equals(t, defaultServerIdleTimeout, srv.Config.IdleTimeout)
+
+	o = &oauth{serverReadTimeout: time.Second, serverWriteTimeout: 2 * time.Second, serverIdleTimeout: 3 * time.Second}
+	srv, err = o.NewServer()
+	assert.FatalError(t, err)
+	srv.Close()
+	assert.Equals(t, time.Second, srv.Config.ReadTimeout)
+	assert.Equals(t, 2*time.Second, srv.Config.WriteTimeout)
+	assert.Equals(t, 3*time.Second, srv.Config.IdleTimeout)
+}
+
+func TestNewServerListenError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.FatalError(t, err)
+	defer l.Close()
+
+	// The effective address is reported.
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	assert.FatalError(t, err)
+	o := &oauth{CallbackListener: ":" + port}
+	_, err = o.NewServer()
+	if err == nil {
+		t.Skip("the port can be reused on this platform")
+	}
+	assert.True(t, strings.Contains(err.Error(), "error listening on 127.0.0.1:"+port), err.Error())
+}
+
+func TestNewServerSlowClient(t *testing.T) {
+	o := &oauth{serverReadTimeout: 100 * time.Millisecond}
+	srv, err := o.NewServer()
+	assert.FatalError(t, err)
+	defer srv.Close()
+
+	// The client never completes the headers.
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	assert.FatalError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n"))
+	assert.FatalError(t, err)
+
+	// The server closes the connection after the read timeout.
+	assert.FatalError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	start := time.Now()
+	_, err = ioutil.ReadAll(conn)
+	assert.FatalError(t, err)
+	assert.True(t, time.Since(start) < 2*time.Second, time.Since(start).String())
+}
+
+// TestListenURLWithRandomPort checks that a fixed redirect_uri can be used
+// while the local server listens on a random port, as it happens when a
+// reverse proxy forwards the registered redirect_uri to the local server.
+func TestListenURLWithRandomPort(t *testing.T) {
+	listenURL := "https://proxy.example.com/oauth/callback"
+
+	var redirectURI string
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirectURI = r.FormValue("redirect_uri")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"the-access-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer tokenSrv.Close()
+
+	opts := &options{
+		Provider:            "https://example.org",
+		CallbackListenerURL: listenURL,
+		CallbackPath:        "/",
+	}
+	assert.FatalError(t, opts.Validate())
+
+	o, err := newOauth("", "client-id", "client-secret", "https://example.org/authorize", tokenSrv.URL, "openid", "", opts)
+	assert.FatalError(t, err)
+
+	srv, err := o.NewServer()
+	assert.FatalError(t, err)
+	defer srv.Close()
+	o.redirectURI = o.CallbackListenerURL
+
+	// The authorization url must use the fixed redirect_uri.
+	authURL, err := o.Auth()
+	assert.FatalError(t, err)
+	u, err := url.Parse(authURL)
+	assert.FatalError(t, err)
+	assert.Equals(t, listenURL, u.Query().Get("redirect_uri"))
+
+	// The root path is not the callback path.
+	resp, err := http.Get(srv.URL + "/?code=the-code&state=" + o.state)
+	assert.FatalError(t, err)
+	resp.Body.Close()
+	assert.Equals(t, http.StatusNotFound, resp.StatusCode)
+
+	// The handler blocks until the token is received.
+	statusCh := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(srv.URL + "/oauth/callback?code=the-code&state=" + o.state)
+		if err != nil {
+			statusCh <- 0
+			return
+		}
+		resp.Body.Close()
+		statusCh <- resp.StatusCode
+	}()
+
+	select {
+	case tok := <-o.tokCh:
+		assert.Equals(t, "the-access-token", tok.AccessToken)
+	case err := <-o.errCh:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for token")
+	}
+	assert.Equals(t, http.StatusOK, <-statusCh)
+
+	// The redirect_uri in the token request must match the authorization one.
+	assert.Equals(t, listenURL, redirectURI)
+}
+
+func TestDiscoveryDefaultScope(t *testing.T) {
+	tests := []struct {
+		name string
+		d    map[string]interface{}
+		want string
+	}{
+		{"list", map[string]interface{}{"default_scopes": []interface{}{"openid", "profile", 1}}, "openid profile"},
+		{"string", map[string]interface{}{"default_scopes": " openid  profile "}, "openid profile"},
+		{"missing", map[string]interface{}{}, ""},
+		{"other", map[string]interface{}{"default_scopes": true}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equals(t, tt.want, discoveryDefaultScope(tt.d))
+		})
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	assert.True(t, hasScope("openid email", "openid"))
+	assert.True(t, hasScope(" email  openid ", "openid"))
+	assert.False(t, hasScope("email profile", "openid"))
+	assert.False(t, hasScope("", "openid"))
+}
+
+func TestIsOIDC(t *testing.T) {
+	assert.True(t, isOIDC(map[string]interface{}{"jwks_uri": "https://example.org/jwks"}))
+	assert.True(t, isOIDC(map[string]interface{}{"id_token_signing_alg_values_supported": []interface{}{"RS256"}}))
+	assert.False(t, isOIDC(map[string]interface{}{"token_endpoint": "https://example.org/token"}))
+}
+
+func TestDoCodeExchange(t *testing.T) {
+	var form url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"the-access-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer srv.Close()
+
+	o := &oauth{
+		clientID:            "client-id",
+		clientSecret:        "client-secret",
+		tokenEndpoint:       srv.URL,
+		codeChallenge:       "random-verifier",
+		CallbackListenerURL: "http://127.0.0.1:10000",
+	}
+
+	tok, err := o.DoCodeExchange("the-code", "the-verifier")
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-access-token", tok.AccessToken)
+	assert.Equals(t, "the-code", form.Get("code"))
+	assert.Equals(t, "the-verifier", form.Get("code_verifier"))
+	assert.Equals(t, "http://127.0.0.1:10000", form.Get("redirect_uri"))
+
+	// Without verifier the parameter is not sent.
+	_, err = o.DoCodeExchange("the-code", "")
+	assert.FatalError(t, err)
+	_, ok := form["code_verifier"]
+	assert.False(t, ok)
+
+	// Public clients do not send the client secret.
+	assert.Equals(t, "client-secret", form.Get("client_secret"))
+	o.clientSecret = ""
+	_, err = o.DoCodeExchange("the-code", "")
+	assert.FatalError(t, err)
+	_, ok = form["client_secret"]
+	assert.False(t, ok)
+
+	// The redirect_uri can be overridden if a proxy rewrites it.
+	o.exchangeRedirectURI = "https://proxy.example.com/callback"
+	_, err = o.DoCodeExchange("the-code", "")
+	assert.FatalError(t, err)
+	assert.Equals(t, "https://proxy.example.com/callback", form.Get("redirect_uri"))
+}
+
+func TestDoRefreshToken(t *testing.T) {
+	var form url.Values
+	body := `{"access_token":"the-access-token","token_type":"Bearer","expires_in":3600}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	o := &oauth{clientID: "client-id", clientSecret: "client-secret", tokenEndpoint: srv.URL}
+	tok, err := o.DoRefreshToken("the-refresh-token", "")
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-access-token", tok.AccessToken)
+	assert.Equals(t, "the-refresh-token", tok.RefreshToken)
+	assert.Equals(t, "refresh_token", form.Get("grant_type"))
+	assert.Equals(t, "the-refresh-token", form.Get("refresh_token"))
+	assert.Equals(t, "client-id", form.Get("client_id"))
+	assert.Equals(t, "client-secret", form.Get("client_secret"))
+	_, ok := form["scope"]
+	assert.False(t, ok)
+
+	// Rotated refresh tokens replace the old one.
+	body = `{"access_token":"the-access-token","refresh_token":"new-refresh-token"}`
+	tok, err = o.DoRefreshToken("the-refresh-token", "read")
+	assert.FatalError(t, err)
+	assert.Equals(t, "new-refresh-token", tok.RefreshToken)
+	assert.Equals(t, "read", form.Get("scope"))
+
+	body = `{"error":"invalid_grant","error_description":"token expired"}`
+	_, err = o.DoRefreshToken("the-refresh-token", "")
+	assert.Error(t, err)
+}
+
+func TestIsTokenValue(t *testing.T) {
+	assert.True(t, isTokenValue(""))
+	assert.True(t, isTokenValue("ya29.a0AfH6SMBx-_~+/="))
+	assert.False(t, isTokenValue("the token"))
+	assert.False(t, isTokenValue("the-token\n"))
+	assert.False(t, isTokenValue("the-tokén"))
+}
+
+func TestExchangeTokenEndpointFailover(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"the-access-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer srv.Close()
+
+	// Get an address that refuses connections.
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := down.URL
+	down.Close()
+
+	o := &oauth{
+		clientID:       "client-id",
+		tokenEndpoint:  downURL,
+		tokenEndpoints: []string{downURL, srv.URL},
+	}
+	tok, err := o.Exchange(o.tokenEndpoint, "the-code")
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-access-token", tok.AccessToken)
+
+	o.tokenEndpoints = nil
+	_, err = o.Exchange(o.tokenEndpoint, "the-code")
+	assert.Error(t, err)
+}
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		flow string
+		want int
+	}{
+		{flowLoopback, 0},
+		{flowDevice, 0},
+		{flowCache, exitStatusCached},
+		{flowCacheRefresh, exitStatusRefreshed},
+		{flowRefreshToken, exitStatusRefreshed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.flow, func(t *testing.T) {
+			err := exitStatus(tt.flow)
+			if tt.want == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			ec, ok := err.(cli.ExitCoder)
+			assert.Fatal(t, ok)
+			assert.Equals(t, tt.want, ec.ExitCode())
+			assert.Equals(t, "", ec.Error())
+		})
+	}
+}
+
+func TestLifetime(t *testing.T) {
+	assert.Equals(t, time.Hour, lifetime(3600, 0))
+	assert.Equals(t, 59*time.Minute+58*time.Second, lifetime(3600, 2*time.Second+100*time.Millisecond))
+	assert.Equals(t, time.Duration(0), lifetime(10, time.Minute))
+}
+
+func TestAuthForceConsent(t *testing.T) {
+	tests := []struct {
+		name          string
+		authzEndpoint string
+		accessType    string
+	}{
+		{"google", "https://accounts.google.com/o/oauth2/v2/auth", "offline"},
+		{"other", "https://example.org/authorize", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &oauth{authzEndpoint: tt.authzEndpoint, prompt: "consent", forceConsent: true}
+			authURL, err := o.Auth()
+			assert.FatalError(t, err)
+			u, err := url.Parse(authURL)
+			assert.FatalError(t, err)
+			assert.Equals(t, "consent", u.Query().Get("prompt"))
+			assert.Equals(t, tt.accessType, u.Query().Get("access_type"))
+		})
+	}
+}
+
+func TestIsCallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		listenURL string
+		path      string
+		want      bool
+	}{
+		{"ok", "", "/?code=the-code&state=the-state", true},
+		{"ok listen-url", "http://127.0.0.1:10000", "/?code=the-code", true},
+		{"ok query", "https://example.org/?tenant=a", "/?tenant=a&code=the-code", true},
+		{"ok query multiple", "https://example.org/?tenant=a&tenant=b", "/?tenant=a&tenant=b&code=the-code", true},
+		{"fail path", "", "/other?code=the-code", false},
+		{"fail missing query", "https://example.org/?tenant=a", "/?code=the-code", false},
+		{"fail query value", "https://example.org/?tenant=a", "/?tenant=b&code=the-code", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &oauth{CallbackPath: "/", CallbackListenerURL: tt.listenURL}
+			req := httptest.NewRequest("GET", tt.path, nil)
+			assert.Equals(t, tt.want, o.isCallback(req))
+		})
+	}
+}
+
+func TestCheckGrantedScope(t *testing.T) {
+	tests := []struct {
+		name      string
+		granted   string
+		requested string
+		required  []string
+		wantErr   bool
+	}{
+		{"ok", "openid email profile", "openid email profile", []string{"email", "profile"}, false},
+		{"ok requested", "", "openid email", []string{"email"}, false},
+		{"fail partial grant", "openid", "openid email", []string{"email"}, true},
+		{"fail requested", "", "openid", []string{"email"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkGrantedScope(&token{Scope: tt.granted}, tt.requested, tt.required)
+			assert.Equals(t, tt.wantErr, err != nil)
+		})
+	}
+}
+
+func TestAuthNonce(t *testing.T) {
+	tests := []struct {
+		name      string
+		o         *oauth
+		wantNonce bool
+	}{
+		{"openid", &oauth{scope: "openid email"}, true},
+		{"oauth", &oauth{scope: "read write"}, false},
+		{"implicit", &oauth{scope: "read", implicit: true}, true},
+		{"nonce", &oauth{scope: "read", sendNonce: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.o.authzEndpoint = "https://example.org/authorize"
+			tt.o.nonce = "the-nonce"
+			authURL, err := tt.o.Auth()
+			assert.FatalError(t, err)
+			u, err := url.Parse(authURL)
+			assert.FatalError(t, err)
+			_, ok := u.Query()["nonce"]
+			assert.Equals(t, tt.wantNonce, ok)
+		})
+	}
+}
+
+func TestBadRequestErrorRedirect(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+
+	o := &oauth{errorRedirect: "https://example.org/error?lang=en", done: done}
+	w := httptest.NewRecorder()
+	o.badRequest(w, "Failed to authenticate: access_denied")
+	assert.Equals(t, http.StatusFound, w.Code)
+	assert.Equals(t, "https://example.org/error?error_description=Failed+to+authenticate%3A+access_denied&lang=en", w.Header().Get("Location"))
+
+	o = &oauth{done: done}
+	w = httptest.NewRecorder()
+	o.badRequest(w, "Failed to authenticate: access_denied")
+	assert.Equals(t, http.StatusBadRequest, w.Code)
+}
+
+func TestSecretLengths(t *testing.T) {
+	tests := []struct {
+		bits                   int
+		state, verifier, nonce int
+	}{
+		{0, 32, 64, 64},
+		{128, 22, 43, 32},
+		{256, 43, 43, 64},
+		{762, 128, 128, 191},
+	}
+	for _, tt := range tests {
+		state, verifier, nonce := secretLengths(tt.bits)
+		assert.Equals(t, tt.state, state)
+		assert.Equals(t, tt.verifier, verifier)
+		assert.Equals(t, tt.nonce, nonce)
+	}
+
+	state, challenge, nonce, err := newSecrets(256)
+	assert.FatalError(t, err)
+	assert.Len(t, 43, state)
+	assert.Len(t, 43, challenge)
+	assert.Len(t, 64, nonce)
+}
+
+func TestServeHTTPFragmentError(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+
+	o := &oauth{CallbackPath: "/callback", done: done}
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/callback", nil))
+	assert.Equals(t, http.StatusOK, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), "urlhash=true"))
+
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/callback?urlhash=true&error=access_denied", nil))
+	assert.Equals(t, http.StatusBadRequest, w.Code)
+}
+
+func TestWaitReady(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.FatalError(t, err)
+	addr := l.Addr()
+	assert.NoError(t, waitReady(addr, time.Second))
+
+	l.Close()
+	assert.Error(t, waitReady(addr, 100*time.Millisecond))
+}
+
+func TestServeHTTPCallbackMethod(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+
+	tests := []struct {
+		callbackMethod string
+		method         string
+		want           int
+	}{
+		{"", "GET", http.StatusOK},
+		{"", "POST", http.StatusOK},
+		{"", "PUT", http.StatusMethodNotAllowed},
+		{"GET", "POST", http.StatusMethodNotAllowed},
+		{"POST", "GET", http.StatusMethodNotAllowed},
+		{"POST", "POST", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.callbackMethod+" "+tt.method, func(t *testing.T) {
+			o := &oauth{CallbackPath: "/callback", callbackMethod: tt.callbackMethod, done: done}
+			w := httptest.NewRecorder()
+			o.ServeHTTP(w, httptest.NewRequest(tt.method, "/callback", nil))
+			assert.Equals(t, tt.want, w.Code)
+		})
+	}
+}
+
+func TestServeHTTPFormPost(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+
+	o := &oauth{CallbackPath: "/callback", callbackMethod: "POST", done: done}
+	req := httptest.NewRequest("POST", "/callback", strings.NewReader("error=access_denied"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, req)
+	assert.Equals(t, http.StatusBadRequest, w.Code)
+}
+
+func TestListScopes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "application/json" {
+			w.Write([]byte(`<html></html>`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/tenant/.well-known/openid-configuration" {
+			w.Write([]byte(`{"issuer":"https://example.org","scopes_supported":["openid","email","profile"]}`))
+			return
+		}
+		w.Write([]byte(`{"issuer":"https://example.org"}`))
+	}))
+	defer srv.Close()
+
+	scopes, err := listScopes(srv.URL+"/tenant", "", "")
+	assert.FatalError(t, err)
+	assert.Equals(t, []string{"openid", "email", "profile"}, scopes)
+
+	_, err = listScopes(srv.URL, "", "")
+	assert.Error(t, err)
+	_, err = listScopes(srv.URL+"/tenant", "text/html", "")
+	assert.Error(t, err)
+
+	// The discovery file is used instead of the provider.
+	dir, err := ioutil.TempDir("", "step-oauth")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "openid-configuration.json")
+	assert.FatalError(t, ioutil.WriteFile(filename, []byte(`{"issuer":"https://example.org","scopes_supported":["openid","offline_access"]}`), 0600))
+	scopes, err = listScopes(srv.URL, "", filename)
+	assert.FatalError(t, err)
+	assert.Equals(t, []string{"openid", "offline_access"}, scopes)
+
+	stdout, _, err := runOauth(t, "--discovery-file", filename, "--list-scopes")
+	assert.FatalError(t, err)
+	assert.Equals(t, "[\n  \"openid\",\n  \"offline_access\"\n]\n", stdout)
+
+	// The providers in the registry do not use discovery.
+	_, _, err = runOauth(t, "--provider", "google", "--discovery-file", filename, "--list-scopes")
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "'--provider google'"), err.Error())
+	_, _, err = runOauth(t, "--provider", "google", "--discovery-file", filename, "--print-config")
+	assert.Error(t, err)
+}
+
+func TestTwoLeggedAssertion(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.FatalError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.FatalError(t, err)
+
+	o := &oauth{
+		clientID:      "the-kid",
+		clientSecret:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		tokenEndpoint: "https://example.org/token",
+		scope:         "read",
+	}
+	raw, err := o.twoLeggedAssertion("sa@example.org")
+	assert.FatalError(t, err)
+
+	jwt, err := jose.ParseSigned(raw)
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-kid", jwt.Headers[0].KeyID)
+	var claims map[string]interface{}
+	assert.FatalError(t, jwt.Claims(key.Public(), &claims))
+	assert.Equals(t, "sa@example.org", claims["iss"])
+	assert.Equals(t, "https://example.org/token", claims["aud"])
+	assert.Equals(t, "read", claims["scope"])
+
+	o.clientSecret = "not a pem"
+	_, err = o.twoLeggedAssertion("sa@example.org")
+	assert.Error(t, err)
+}
+
+func TestSiblingTokenEndpoint(t *testing.T) {
+	tests := []struct {
+		authzEp string
+		want    string
+		wantErr bool
+	}{
+		{"https://example.org/oauth/authorize", "https://example.org/oauth/token", false},
+		{"https://example.org/oauth2/v1/auth/?prompt=login", "https://example.org/oauth2/v1/token", false},
+		{"https://example.org/authorize", "https://example.org/token", false},
+		{"https://example.org", "https://example.org/token", false},
+		{"/oauth/authorize", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.authzEp, func(t *testing.T) {
+			got, err := siblingTokenEndpoint(tt.authzEp)
+			assert.Equals(t, tt.wantErr, err != nil)
+			assert.Equals(t, tt.want, got)
+		})
+	}
+}
+
+func TestDoTwoLeggedAuthorizationTokenAuth(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.FatalError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.FatalError(t, err)
+
+	var req *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		req = r
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"the-access-token","token_type":"Bearer"}`))
+	}))
+	defer srv.Close()
+
+	o := &oauth{
+		clientID:          "the-kid",
+		clientSecret:      string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		tokenEndpoint:     srv.URL,
+		tokenAuthMethod:   tokenAuthBasic,
+		tokenAuthClientID: "client id",
+		tokenAuthSecret:   "client:secret",
+	}
+	_, err = o.DoTwoLeggedAuthorization("sa@example.org")
+	assert.FatalError(t, err)
+	username, password, ok := req.BasicAuth()
+	assert.True(t, ok)
+	assert.Equals(t, "client+id", username)
+	assert.Equals(t, "client%3Asecret", password)
+	assert.Equals(t, "", req.PostForm.Get("client_secret"))
+
+	o.tokenAuthMethod = tokenAuthPost
+	_, err = o.DoTwoLeggedAuthorization("sa@example.org")
+	assert.FatalError(t, err)
+	_, _, ok = req.BasicAuth()
+	assert.False(t, ok)
+	assert.Equals(t, "client id", req.PostForm.Get("client_id"))
+	assert.Equals(t, "client:secret", req.PostForm.Get("client_secret"))
+	assert.Equals(t, jwtBearerUrn, req.PostForm.Get("grant_type"))
+}
+
+func TestDoClientCredentialsAuthorization(t *testing.T) {
+	var req *http.Request
+	body := `{"access_token":"the-access-token","token_type":"Bearer","expires_in":3600}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		req = r
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	o := &oauth{clientID: "client-id", clientSecret: "client-secret", tokenEndpoint: srv.URL}
+	tok, err := o.DoClientCredentialsAuthorization("read write")
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-access-token", tok.AccessToken)
+	assert.Equals(t, "client_credentials", req.PostForm.Get("grant_type"))
+	assert.Equals(t, "read write", req.PostForm.Get("scope"))
+	assert.Equals(t, "client-id", req.PostForm.Get("client_id"))
+	assert.Equals(t, "client-secret", req.PostForm.Get("client_secret"))
+	_, _, ok := req.BasicAuth()
+	assert.False(t, ok)
+
+	o.tokenAuthMethod = tokenAuthBasic
+	_, err = o.DoClientCredentialsAuthorization("")
+	assert.FatalError(t, err)
+	username, password, ok := req.BasicAuth()
+	assert.True(t, ok)
+	assert.Equals(t, "client-id", username)
+	assert.Equals(t, "client-secret", password)
+	assert.Equals(t, "", req.PostForm.Get("client_secret"))
+	_, ok = req.PostForm["scope"]
+	assert.False(t, ok)
+
+	body = `{"error":"invalid_client"}`
+	_, err = o.DoClientCredentialsAuthorization("")
+	assert.Error(t, err)
+}
+
+func TestNewOauthDiscoveryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-oauth")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "openid-configuration.json")
+	assert.FatalError(t, ioutil.WriteFile(filename, []byte(`{
+		"issuer": "https://example.org",
+		"authorization_endpoint": "https://example.org/authorize",
+		"token_endpoint": "https://example.org/token",
+		"jwks_uri": "https://example.org/jwks"
+	}`), 0600))
+
+	opts := &options{DiscoveryFile: filename, CallbackPath: "/"}
+	assert.FatalError(t, opts.Validate())
+	o, err := newOauth("", "client-id", "client-secret", "", "", "openid", "", opts)
+	assert.FatalError(t, err)
+	assert.Equals(t, "https://example.org", o.provider)
+	assert.Equals(t, "https://example.org/authorize", o.authzEndpoint)
+	assert.Equals(t, "https://example.org/token", o.tokenEndpoint)
+	assert.Equals(t, "openid", o.scope)
+	assert.Equals(t, "", o.audience)
+
+	// Defaults advertised by the provider are used if --scope is not set.
+	assert.FatalError(t, ioutil.WriteFile(filename, []byte(`{
+		"issuer": "https://example.org",
+		"authorization_endpoint": "https://example.org/authorize",
+		"token_endpoint": "https://example.org/token",
+		"default_scopes": ["openid", "offline_access"],
+		"default_audience": "https://api.example.org"
+	}`), 0600))
+	o, err = newOauth("", "client-id", "client-secret", "", "", "openid email", "", opts)
+	assert.FatalError(t, err)
+	assert.Equals(t, "openid offline_access", o.scope)
+	assert.Equals(t, "https://api.example.org", o.audience)
+	authURL, err := o.Auth()
+	assert.FatalError(t, err)
+	u, err := url.Parse(authURL)
+	assert.FatalError(t, err)
+	assert.Equals(t, "https://api.example.org", u.Query().Get("audience"))
+
+	opts.ScopeSet = true
+	o, err = newOauth("", "client-id", "client-secret", "", "", "openid email", "", opts)
+	assert.FatalError(t, err)
+	assert.Equals(t, "openid email", o.scope)
+
+	opts.DiscoveryFile = filepath.Join(dir, "missing.json")
+	_, err = newOauth("", "client-id", "client-secret", "", "", "openid", "", opts)
+	assert.Error(t, err)
+}
+
+func TestServeHTTPEmptyCode(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+
+	o := &oauth{CallbackPath: "/callback", state: "the-state", done: done}
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/callback?code=%20%20&state=the-state", nil))
+	assert.Equals(t, http.StatusBadRequest, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), "empty authorization code"))
+}
+
+func TestServeHTTPInvalidRequests(t *testing.T) {
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"the-access-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer tokenSrv.Close()
+
+	o := &oauth{
+		CallbackPath:  "/callback",
+		state:         "the-state",
+		tokenEndpoint: tokenSrv.URL,
+		errCh:         make(chan error, 1),
+		tokCh:         make(chan *token, 1),
+		done:          make(chan struct{}),
+	}
+	// Any number of stray requests is ignored.
+	for i := 0; i < 20; i++ {
+		for _, target := range []string{"/callback?state=the-state&urlhash=true", "/callback?code=the-code", "/callback?code=the-code&state=other-state"} {
+			w := httptest.NewRecorder()
+			o.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+			assert.Equals(t, http.StatusBadRequest, w.Code)
+		}
+	}
+	assert.Equals(t, 60, o.invalidRequests)
+	select {
+	case err := <-o.errCh:
+		t.Fatalf("unexpected error: %v", err)
+	default:
+	}
+
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/callback?code=the-code&state=the-state", nil))
+	assert.Equals(t, http.StatusOK, w.Code)
+	assert.Equals(t, "the-access-token", (<-o.tokCh).AccessToken)
+}
+
+func TestServeHTTPInteractionRequired(t *testing.T) {
+	o := &oauth{CallbackPath: "/callback", state: "the-state", prompt: "none", errCh: make(chan error, 1), done: make(chan struct{})}
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/callback?error=login_required&error_description=no+session&state=the-state", nil))
+	assert.Equals(t, http.StatusBadRequest, w.Code)
+	err := <-o.errCh
+	ire, ok := err.(*interactionRequiredError)
+	assert.Fatal(t, ok)
+	assert.Equals(t, "login_required", ire.Err)
+	assert.Equals(t, "no session", ire.ErrDesc)
+	assert.True(t, strings.Contains(w.Body.String(), "retry without '--prompt none'"))
+
+	// Other errors are not mapped.
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/callback?error=access_denied&state=the-state", nil))
+	err = <-o.errCh
+	_, ok = err.(*interactionRequiredError)
+	assert.False(t, ok)
+
+	// The errors are only mapped with prompt=none.
+	o.prompt = "login"
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/callback?error=login_required&state=the-state", nil))
+	err = <-o.errCh
+	_, ok = err.(*interactionRequiredError)
+	assert.False(t, ok)
+}
+
+func TestImplicitHandler(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		code  int
+		want  *token
+	}{
+		{"ok", "urlhash=true&state=the-state&access_token=the-access-token&token_type=Bearer&expires_in=3600&unknown=value",
+			http.StatusOK, &token{AccessToken: "the-access-token", TokenType: "Bearer", ExpiresIn: 3600}},
+		{"ok id token", "urlhash=true&state=the-state&access_token=the-access-token&id_token=the-id-token",
+			http.StatusOK, &token{AccessToken: "the-access-token", IDToken: "the-id-token", TokenType: "Bearer"}},
+		{"fail missing state", "urlhash=true&access_token=the-access-token", http.StatusBadRequest, nil},
+		{"fail invalid state", "urlhash=true&state=other-state&access_token=the-access-token", http.StatusBadRequest, nil},
+		{"fail missing access token", "urlhash=true&state=the-state&id_token=the-id-token", http.StatusBadRequest, nil},
+		{"fail invalid token", "urlhash=true&state=the-state&access_token=the-access-token&token_type=Bearer%0A", http.StatusBadRequest, nil},
+		{"fail expires_in", "urlhash=true&state=the-state&access_token=the-access-token&expires_in=-1", http.StatusBadRequest, nil},
+		{"fail malformed", "urlhash=true&state=%zz", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &oauth{
+				CallbackPath: "/",
+				implicit:     true,
+				state:        "the-state",
+				tokCh:        make(chan *token, 1),
+				errCh:        make(chan error, 1),
+				done:         make(chan struct{}),
+			}
+			w := httptest.NewRecorder()
+			o.ServeHTTP(w, httptest.NewRequest("GET", "/?"+tt.query, nil))
+			assert.Equals(t, tt.code, w.Code)
+			if tt.want == nil {
+				assert.Len(t, 0, o.tokCh)
+				assert.Len(t, 1, o.errCh)
+				return
+			}
+			assert.Equals(t, tt.want, <-o.tokCh)
+		})
+	}
+
+	// The first request serves the page that sends the fragment back.
+	o := &oauth{CallbackPath: "/", implicit: true, state: "the-state", done: make(chan struct{})}
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equals(t, http.StatusOK, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), "urlhash=true"))
+}
+
+func TestServeHTTPBrowserAssets(t *testing.T) {
+	o := &oauth{CallbackPath: "/callback"}
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/favicon.ico", nil))
+	assert.Equals(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/other", nil))
+	assert.Equals(t, http.StatusNotFound, w.Code)
+}
+
+func TestOOBRedirectURI(t *testing.T) {
+	o := &oauth{}
+	assert.Equals(t, oobCallbackUrn, o.oobRedirectURI())
+	assert.Equals(t, oobCallbackUrn, o.config(flowConsole).RedirectURI)
+
+	o.consoleRedirectURI = "https://example.org/oauth/code"
+	assert.Equals(t, "https://example.org/oauth/code", o.oobRedirectURI())
+	assert.Equals(t, "https://example.org/oauth/code", o.config(flowConsole).RedirectURI)
+}
+
+func TestParseTokenParams(t *testing.T) {
+	params, err := parseTokenParams([]string{"tenant=common", "resource=a", "resource=b", "empty=", "note=a=b"})
+	assert.FatalError(t, err)
+	assert.Equals(t, url.Values{
+		"tenant":   {"common"},
+		"resource": {"a", "b"},
+		"empty":    {""},
+		"note":     {"a=b"},
+	}, params)
+
+	_, err = parseTokenParams([]string{"tenant"})
+	assert.Error(t, err)
+	_, err = parseTokenParams([]string{"=common"})
+	assert.Error(t, err)
+}
+
+func TestPostFormTokenParams(t *testing.T) {
+	var form url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"the-access-token","token_type":"Bearer"}`))
+	}))
+	defer srv.Close()
+
+	o := &oauth{
+		clientID:      "client-id",
+		tokenEndpoint: srv.URL,
+		tokenParams:   url.Values{"tenant": {"common"}, "grant_type": {"password"}},
+	}
+	_, err := o.Exchange(srv.URL, "the-code")
+	assert.FatalError(t, err)
+	assert.Equals(t, "common", form.Get("tenant"))
+	assert.Equals(t, "authorization_code", form.Get("grant_type"))
+	assert.Equals(t, "the-code", form.Get("code"))
+}
+
+func TestAuthURLHook(t *testing.T) {
+	o := &oauth{authzEndpoint: "https://example.org/authorize", scope: "openid", state: "the-state"}
+	o.AuthURLHook = func(u *url.URL) error {
+		q := u.Query()
+		q.Set("signature", "the-signature")
+		q.Del("state")
+		u.RawQuery = q.Encode()
+		return nil
+	}
+	authURL, err := o.Auth()
+	assert.FatalError(t, err)
+	u, err := url.Parse(authURL)
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-signature", u.Query().Get("signature"))
+	assert.Equals(t, "", u.Query().Get("state"))
+	assert.Equals(t, "openid", u.Query().Get("scope"))
+
+	o.AuthURLHook = func(u *url.URL) error {
+		return errors.New("hook failed")
+	}
+	_, err = o.Auth()
+	assert.Error(t, err)
+}
+
+// runOauth runs step oauth with the given arguments and returns what it
+// writes to the standard output and the standard error.
+func runOauth(t *testing.T, args ...string) (stdout, stderr string, err error) {
+	t.Helper()
+	return runCommand(t, oauthCommand(t), args...)
+}
+
+// oauthCommand returns the registered step oauth command.
+func oauthCommand(t *testing.T) cli.Command {
+	t.Helper()
+	var cmd cli.Command
+	for _, c := range command.Retrieve() {
+		if c.Name == "oauth" {
+			cmd = c
+		}
+	}
+	assert.Equals(t, "oauth", cmd.Name)
+	return cmd
+}
+
+// runCommand runs the given command with the given arguments, and returns the
+// standard output and error.
+func runCommand(t *testing.T, cmd cli.Command, args ...string) (stdout, stderr string, err error) {
+	t.Helper()
+	capture := func(f **os.File) func() string {
+		r, w, err := os.Pipe()
+		assert.FatalError(t, err)
+		orig := *f
+		*f = w
+		ch := make(chan string)
+		go func() {
+			b, _ := ioutil.ReadAll(r)
+			ch <- string(b)
+		}()
+		return func() string {
+			*f = orig
+			w.Close()
+			return <-ch
+		}
+	}
+	restoreStdout := capture(&os.Stdout)
+	restoreStderr := capture(&os.Stderr)
+
+	app := cli.NewApp()
+	app.Commands = []cli.Command{cmd}
+	// Return the exit errors instead of exiting.
+	app.ExitErrHandler = func(*cli.Context, error) {}
+	err = app.Run(append([]string{"step", "oauth"}, args...))
+	return restoreStdout(), restoreStderr(), err
+}
+
+// writeSigningKey writes a new JWK to the given directory and returns its
+// path, to be used with --self-signed.
+func writeSigningKey(t *testing.T, dir string) string {
+	t.Helper()
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "the-kid", 0)
+	assert.FatalError(t, err)
+	b, err := json.Marshal(jwk)
+	assert.FatalError(t, err)
+	filename := filepath.Join(dir, "key.json")
+	assert.FatalError(t, ioutil.WriteFile(filename, b, 0600))
+	return filename
+}
+
+func TestOauthCmdOutputFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+		check func(t *testing.T, b []byte, tok string)
+	}{
+		{"env-file", []string{"env-file"}, func(t *testing.T, b []byte, tok string) {
+			assert.True(t, strings.HasPrefix(string(b), "ACCESS_TOKEN="+tok+"\n"), string(b))
+		}},
+		{"header-file", []string{"header-file"}, func(t *testing.T, b []byte, tok string) {
+			assert.Equals(t, `header = "Authorization: Bearer `+tok+`"`+"\n", string(b))
+		}},
+		{"token-out", []string{"access-token-out", "id-token-out"}, func(t *testing.T, b []byte, tok string) {
+			assert.Equals(t, tok, string(b))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "step-oauth")
+			assert.FatalError(t, err)
+			defer os.RemoveAll(dir)
+
+			args := []string{"--self-signed", "--signing-key", writeSigningKey(t, dir), "--claim", "aud=my-service", "--bare"}
+			for _, f := range tt.flags {
+				args = append(args, "--"+f, filepath.Join(dir, f))
+			}
+			// The second run replaces the files.
+			var tokens []string
+			for i := 0; i < 2; i++ {
+				stdout, _, err := runOauth(t, args...)
+				assert.FatalError(t, err)
+				tokens = append(tokens, strings.TrimSpace(stdout))
+			}
+			assert.NotEquals(t, tokens[0], tokens[1])
+			for _, f := range tt.flags {
+				b, err := ioutil.ReadFile(filepath.Join(dir, f))
+				assert.FatalError(t, err)
+				tt.check(t, b, tokens[1])
+			}
+		})
+	}
+}
+
+func TestDoServe(t *testing.T) {
+	var mu sync.Mutex
+	verifiers := map[string]string{}
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		code := r.PostForm.Get("code")
+		mu.Lock()
+		verifiers[code] = r.PostForm.Get("code_verifier")
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token-` + code + `","refresh_token":"the-refresh-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer tokenSrv.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.FatalError(t, err)
+	listen := l.Addr().String()
+	l.Close()
+
+	opts := &options{Provider: "https://example.org", CallbackListener: listen, CallbackPath: "/", Serve: true}
+	assert.FatalError(t, opts.Validate())
+	o, err := newOauth("", "client-id", "", "https://example.org/authorize", tokenSrv.URL, "openid email", "", opts)
+	assert.FatalError(t, err)
+
+	// Stop serving after two rounds.
+	var rounds []*roundToken
+	errDone := errors.New("done")
+	serveCh := make(chan error, 1)
+	go func() {
+		serveCh <- o.DoServe(func(rt *roundToken) error {
+			rounds = append(rounds, rt)
+			if len(rounds) == 2 {
+				return errDone
+			}
+			return nil
+		})
+	}()
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(u string) *http.Response {
+		t.Helper()
+		var resp *http.Response
+		for i := 0; i < 50; i++ {
+			if resp, err = client.Get(u); err == nil {
+				resp.Body.Close()
+				return resp
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatal(err)
+		return nil
+	}
+	authorize := func(query string) url.Values {
+		t.Helper()
+		resp := get("http://" + listen + "/authorize" + query)
+		assert.Equals(t, http.StatusFound, resp.StatusCode)
+		u, err := url.Parse(resp.Header.Get("Location"))
+		assert.FatalError(t, err)
+		return u.Query()
+	}
+
+	// Two rounds in flight, the second one uses the configured scope.
+	q1 := authorize("?scope=read")
+	q2 := authorize("")
+	assert.NotEquals(t, q1.Get("state"), q2.Get("state"))
+	assert.NotEquals(t, q1.Get("code_challenge"), q2.Get("code_challenge"))
+	assert.Equals(t, "read", q1.Get("scope"))
+	assert.Equals(t, "openid email", q2.Get("scope"))
+	assert.Equals(t, "openid email", o.scope)
+
+	// Rounds are completed in any order.
+	resp := get("http://" + listen + "/?code=code-2&state=" + q2.Get("state"))
+	assert.Equals(t, http.StatusOK, resp.StatusCode)
+	resp = get("http://" + listen + "/?code=code-1&state=" + q1.Get("state"))
+	assert.Equals(t, http.StatusOK, resp.StatusCode)
+
+	select {
+	case err := <-serveCh:
+		assert.Equals(t, errDone, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the rounds")
+	}
+
+	// Each round uses its own verifier.
+	for _, q := range []url.Values{q1, q2} {
+		code := "code-1"
+		if q.Get("state") == q2.Get("state") {
+			code = "code-2"
+		}
+		s256 := sha256.Sum256([]byte(verifiers[code]))
+		assert.Equals(t, q.Get("code_challenge"), base64.RawURLEncoding.EncodeToString(s256[:]))
+	}
+
+	assert.Len(t, 2, rounds)
+	assert.Equals(t, 2, rounds[0].Round)
+	assert.Equals(t, "openid email", rounds[0].RequestedScope)
+	assert.Equals(t, "token-code-2", rounds[0].AccessToken)
+	assert.Equals(t, 1, rounds[1].Round)
+	assert.Equals(t, "read", rounds[1].RequestedScope)
+	assert.Equals(t, "token-code-1", rounds[1].AccessToken)
+
+	b, err := json.Marshal(rounds[1])
+	assert.FatalError(t, err)
+	var m map[string]interface{}
+	assert.FatalError(t, json.Unmarshal(b, &m))
+	assert.Equals(t, float64(1), m["round"])
+	assert.Equals(t, "read", m["requested_scope"])
+	assert.Equals(t, "token-code-1", m["access_token"])
+}
+
+func TestServeHTTPRoundReplay(t *testing.T) {
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"the-access-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer tokenSrv.Close()
+
+	o := &oauth{
+		CallbackPath:  "/",
+		serve:         true,
+		scope:         "openid",
+		authzEndpoint: "https://example.org/authorize",
+		tokenEndpoint: tokenSrv.URL,
+		rounds:        make(map[string]*serveRound),
+		roundCh:       make(chan *roundToken, 1),
+		errCh:         make(chan error, 1),
+		done:          make(chan struct{}),
+	}
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/authorize", nil))
+	assert.Equals(t, http.StatusFound, w.Code)
+	u, err := url.Parse(w.Header().Get("Location"))
+	assert.FatalError(t, err)
+	state := u.Query().Get("state")
+
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/?code=the-code&state="+state, nil))
+	assert.Equals(t, http.StatusOK, w.Code)
+	rt := <-o.roundCh
+	assert.Equals(t, 1, rt.Round)
+	assert.Equals(t, "openid", rt.RequestedScope)
+
+	// A state can only be used once.
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/?code=the-code&state="+state, nil))
+	assert.Equals(t, http.StatusBadRequest, w.Code)
+}
+
+func TestWriteTokenServe(t *testing.T) {
+	tok := &token{AccessToken: "the-access-token", RefreshToken: "the-refresh-token", TokenType: "Bearer", ExpiresIn: 3600}
+	rt := &roundToken{Round: 2, RequestedScope: "read", token: tok}
+	run := func(args ...string) string {
+		t.Helper()
+		cmd := oauthCommand(t)
+		cmd.Action = func(c *cli.Context) error {
+			return writeToken(c, &oauth{scope: "openid"}, flowLoopback, rt.token, time.Now(), rt)
+		}
+		stdout, _, err := runCommand(t, cmd, args...)
+		assert.FatalError(t, err)
+		return stdout
+	}
+
+	var m map[string]interface{}
+	assert.FatalError(t, json.Unmarshal([]byte(run()), &m))
+	assert.Equals(t, float64(2), m["round"])
+	assert.Equals(t, "read", m["requested_scope"])
+	assert.Equals(t, "the-refresh-token", m["refresh_token"])
+
+	// The refresh token is removed with --no-refresh-token.
+	m = nil
+	assert.FatalError(t, json.Unmarshal([]byte(run("--no-refresh-token")), &m))
+	assert.Equals(t, float64(2), m["round"])
+	assert.Equals(t, "the-access-token", m["access_token"])
+	assert.Equals(t, "", m["refresh_token"])
+	assert.Equals(t, "the-refresh-token", tok.RefreshToken)
+
+	assert.Equals(t, "the-access-token\n", run("--bare"))
+}
+
+func TestOauthCmdDefaultClientWarning(t *testing.T) {
+	const warning = "using the shared default client"
+	dir, err := ioutil.TempDir("", "step-oauth")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Flows without user authorization do not use the client.
+	key := writeSigningKey(t, dir)
+	_, stderr, err := runOauth(t, "--self-signed", "--signing-key", key, "--claim", "aud=my-service", "--bare")
+	assert.FatalError(t, err)
+	assert.False(t, strings.Contains(stderr, warning), stderr)
+
+	// The device flow uses the default client.
+	deviceSleep = func(time.Duration) {}
+	defer func() {
+		deviceSleep = time.Sleep
+	}()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/device":
+			w.Write([]byte(`{"device_code":"the-device-code","user_code":"ABCD-EFGH","verification_uri":"https://example.org/device","expires_in":600,"interval":1}`))
+		case "/token":
+			w.Write([]byte(`{"access_token":"the-access-token","token_type":"Bearer","expires_in":3600}`))
+		}
+	}))
+	defer srv.Close()
+	google := providers["google"]
+	providers["google"] = &providerConfig{
+		AuthorizationEndpoint:       "https://example.org/authorize",
+		TokenEndpoint:               srv.URL + "/token",
+		DeviceAuthorizationEndpoint: srv.URL + "/device",
+	}
+	defer func() {
+		providers["google"] = google
+	}()
+	_, stderr, err = runOauth(t, "--device", "--bare")
+	assert.FatalError(t, err)
+	assert.True(t, strings.Contains(stderr, warning), stderr)
+
+	assert.True(t, authorizesUser(flowLoopback))
+	assert.True(t, authorizesUser(flowConsole))
+	for _, flow := range []string{flowTwoLegged, flowJWT, flowClientCredentials, flowTokenExchange, flowExchangeCode, flowRefreshToken, flowSelfSigned} {
+		assert.False(t, authorizesUser(flow), flow)
+	}
+}
+
+func TestOauthCmdNoReauth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-oauth")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+	fn := cacheDir
+	cacheDir = func() string { return dir }
+	defer func() { cacheDir = fn }()
+	interactive := isInteractive
+	isInteractive = func() bool { return true }
+	defer func() { isInteractive = interactive }()
+	deviceSleep = func(time.Duration) {}
+	defer func() { deviceSleep = time.Sleep }()
+
+	var authorizations int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/device":
+			authorizations++
+			w.Write([]byte(`{"device_code":"the-device-code","user_code":"ABCD-EFGH","verification_uri":"https://example.org/device","expires_in":600,"interval":1}`))
+		case r.FormValue("refresh_token") == "a-revoked-token":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`))
+		case r.FormValue("refresh_token") != "":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":"temporarily_unavailable"}`))
+		default:
+			w.Write([]byte(`{"access_token":"the-new-access-token","token_type":"Bearer","expires_in":3600}`))
+		}
+	}))
+	defer srv.Close()
+	google := providers["google"]
+	providers["google"] = &providerConfig{
+		AuthorizationEndpoint:       "https://example.org/authorize",
+		TokenEndpoint:               srv.URL + "/token",
+		DeviceAuthorizationEndpoint: srv.URL + "/device",
+	}
+	defer func() { providers["google"] = google }()
+
+	filename := cacheFilename("google", srv.URL+"/token", defaultClientID, "openid email")
+	expired := func(refreshToken string) {
+		t.Helper()
+		assert.FatalError(t, writeCache(filename, cacheKey{}, &token{AccessToken: "the-access-token", RefreshToken: refreshToken, ExpiresIn: 3600}, time.Now().Add(-2*time.Hour)))
+	}
+
+	// The rejected refresh token exits with its own code.
+	expired("a-revoked-token")
+	_, _, err = runOauth(t, "--cache", "--no-reauth", "--device", "--bare")
+	ec, ok := err.(cli.ExitCoder)
+	assert.Fatal(t, ok, err)
+	assert.Equals(t, exitReauthRequired, ec.ExitCode())
+	assert.True(t, strings.Contains(err.Error(), "invalid_grant"), err.Error())
+	assert.Equals(t, 0, authorizations)
+
+	// Other refresh errors fail without a new authorization.
+	expired("the-refresh-token")
+	_, _, err = runOauth(t, "--cache", "--no-reauth", "--device", "--bare")
+	assert.Error(t, err)
+	_, ok = err.(cli.ExitCoder)
+	assert.False(t, ok)
+	assert.Equals(t, 0, authorizations)
+
+	// Without --no-reauth a new authorization replaces the cached token.
+	expired("a-revoked-token")
+	stdout, stderr, err := runOauth(t, "--cache", "--device", "--bare")
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-new-access-token\n", stdout)
+	assert.True(t, strings.Contains(stderr, "starting a new authorization"), stderr)
+	assert.Equals(t, 1, authorizations)
+
+	// --no-reauth requires --cache.
+	_, _, err = runOauth(t, "--no-reauth", "--device")
+	assert.Error(t, err)
+}
+
+func TestOauthCmdExchangeCodeRequiresListenURL(t *testing.T) {
+	_, _, err := runOauth(t, "--exchange-code", "the-code", "--client-id", "client-id", "--token-endpoint", "https://example.org/token")
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "'--listen-url'"), err.Error())
+}
+
+func TestDoLoopbackAuthorizationCleanup(t *testing.T) {
+	var fail bool
+	exchangingCh, releaseCh := make(chan struct{}), make(chan struct{})
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exchangingCh <- struct{}{}
+		<-releaseCh
+		w.Header().Set("Content-Type", "application/json")
+		if fail {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"the-access-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer tokenSrv.Close()
+	defer close(releaseCh)
+
+	// The browser sends the callback.
+	redirectCh := make(chan string, 1)
+	openInBrowser = func(authURL, browser string) error {
+		u, err := url.Parse(authURL)
+		if err != nil {
+			return err
+		}
+		q := u.Query()
+		redirectCh <- q.Get("redirect_uri")
+		go func() {
+			if resp, err := http.Get(q.Get("redirect_uri") + "?code=the-code&state=" + q.Get("state")); err == nil {
+				resp.Body.Close()
+			}
+		}()
+		return nil
+	}
+	defer func() {
+		openInBrowser = exec.OpenInBrowser
+	}()
+
+	goroutines := runtime.NumGoroutine()
+	for _, fail = range []bool{false, true} {
+		opts := &options{Provider: "https://example.org", CallbackPath: "/"}
+		assert.FatalError(t, opts.Validate())
+		o, err := newOauth("", "client-id", "", "https://example.org/authorize", tokenSrv.URL, "openid", "", opts)
+		assert.FatalError(t, err)
+
+		type result struct {
+			tok *token
+			err error
+		}
+		resultCh := make(chan result, 1)
+		go func() {
+			tok, err := o.DoLoopbackAuthorization()
+			resultCh <- result{tok, err}
+		}()
+		redirectURI := <-redirectCh
+		<-exchangingCh
+
+		// Other requests are answered during the exchange.
+		resp, err := (&http.Client{Timeout: 5 * time.Second}).Get(redirectURI + "/favicon.ico")
+		assert.FatalError(t, err)
+		resp.Body.Close()
+		assert.Equals(t, http.StatusNoContent, resp.StatusCode)
+		releaseCh <- struct{}{}
+
+		select {
+		case res := <-resultCh:
+			if fail {
+				assert.Error(t, res.err)
+			} else {
+				assert.FatalError(t, res.err)
+				assert.Equals(t, "the-access-token", res.tok.AccessToken)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the flow")
+		}
+
+		// The server is closed.
+		_, err = http.Get(redirectURI)
+		assert.Error(t, err)
+	}
+
+	// And no goroutine is left behind.
+	http.DefaultClient.CloseIdleConnections()
+	httpClient.CloseIdleConnections()
+	for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= goroutines, fmt.Sprintf("%d goroutines, want %d", runtime.NumGoroutine(), goroutines))
+}
+
+func TestDoLoopbackAuthorizationTimeouts(t *testing.T) {
+	// The token endpoint takes its time to send the headers.
+	var delay time.Duration
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The body is read so the request context is canceled if the
+		// connection is closed.
+		r.ParseForm()
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"the-access-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer tokenSrv.Close()
+
+	var callback bool
+	openInBrowser = func(authURL, browser string) error {
+		u, err := url.Parse(authURL)
+		if err != nil {
+			return err
+		}
+		q := u.Query()
+		if callback {
+			go func() {
+				if resp, err := http.Get(q.Get("redirect_uri") + "?code=the-code&state=" + q.Get("state")); err == nil {
+					resp.Body.Close()
+				}
+			}()
+		}
+		return nil
+	}
+	defer func() {
+		openInBrowser = exec.OpenInBrowser
+	}()
+
+	tests := []struct {
+		name            string
+		callback        bool
+		delay           time.Duration
+		browserTimeout  time.Duration
+		exchangeTimeout time.Duration
+		err             string
+	}{
+		{"ok", true, 0, time.Second, time.Second, ""},
+		{"ok slow exchange", true, 500 * time.Millisecond, 100 * time.Millisecond, 5 * time.Second, ""},
+		{"fail browser", false, 0, 100 * time.Millisecond, 5 * time.Second, "oauth command timed out, please try again"},
+		{"fail exchange", true, 5 * time.Second, 5 * time.Second, 100 * time.Millisecond, "oauth command timed out exchanging the authorization code, please try again"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			callback, delay = tt.callback, tt.delay
+			opts := &options{Provider: "https://example.org", CallbackPath: "/"}
+			assert.FatalError(t, opts.Validate())
+			o, err := newOauth("", "client-id", "", "https://example.org/authorize", tokenSrv.URL, "openid", "", opts)
+			assert.FatalError(t, err)
+			o.browserTimeout, o.exchangeTimeout = tt.browserTimeout, tt.exchangeTimeout
+
+			start := time.Now()
+			tok, err := o.DoLoopbackAuthorization()
+			if tt.err != "" {
+				assert.Error(t, err)
+				assert.Equals(t, tt.err, err.Error())
+				// The flow does not wait for the token endpoint.
+				assert.True(t, time.Since(start) < 2*time.Second, time.Since(start).String())
+			} else {
+				assert.FatalError(t, err)
+				assert.Equals(t, "the-access-token", tok.AccessToken)
+			}
+		})
+	}
+}
+
+func TestServeHTTPConcurrentRounds(t *testing.T) {
+	// Both exchanges are in progress at the same time.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		wg.Done()
+		wg.Wait()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token-` + r.PostForm.Get("code") + `","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer tokenSrv.Close()
+
+	o := &oauth{
+		CallbackPath:  "/",
+		serve:         true,
+		scope:         "openid",
+		authzEndpoint: "https://example.org/authorize",
+		tokenEndpoint: tokenSrv.URL,
+		rounds:        make(map[string]*serveRound),
+		roundCh:       make(chan *roundToken),
+		errCh:         make(chan error),
+		done:          make(chan struct{}),
+	}
+	defer close(o.done)
+
+	var states []string
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		o.ServeHTTP(w, httptest.NewRequest("GET", "/authorize", nil))
+		u, err := url.Parse(w.Header().Get("Location"))
+		assert.FatalError(t, err)
+		states = append(states, u.Query().Get("state"))
+	}
+	for i, state := range states {
+		go o.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?code=code-"+strconv.Itoa(i)+"&state="+state, nil))
+	}
+	tokens := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case rt := <-o.roundCh:
+			tokens[rt.AccessToken] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the rounds")
+		}
+	}
+	assert.Equals(t, map[string]bool{"token-code-0": true, "token-code-1": true}, tokens)
+
+	// A pending error does not block the other requests.
+	go o.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?error=access_denied", nil))
+	time.Sleep(50 * time.Millisecond)
+	doneCh := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		o.ServeHTTP(w, httptest.NewRequest("GET", "/favicon.ico", nil))
+		doneCh <- w.Code
+	}()
+	select {
+	case code := <-doneCh:
+		assert.Equals(t, http.StatusNoContent, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request blocked by a pending error")
+	}
+	assert.Equals(t, "Failed to authenticate: access_denied", (<-o.errCh).Error())
+}
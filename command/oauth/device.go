@@ -0,0 +1,202 @@
+package oauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/boombuler/barcode/qr"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultDeviceInterval is the polling interval used if the device
+	// authorization response does not include one, as defined in RFC 8628,
+	// section 3.2.
+	defaultDeviceInterval = 5 * time.Second
+	// slowDownInterval is the increment of the polling interval after a
+	// slow_down error, as defined in RFC 8628, section 3.5.
+	slowDownInterval = 5 * time.Second
+	// defaultDeviceExpiration is the lifetime of the device code used if the
+	// response does not include one.
+	defaultDeviceExpiration = 10 * time.Minute
+)
+
+// deviceSleep waits between the token requests of the device flow, it is
+// replaced in the tests.
+var deviceSleep = time.Sleep
+
+// deviceAuthorization is the response of the device authorization endpoint, as
+// defined in RFC 8628, section 3.2.
+type deviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	VerificationURL         string `json:"verification_url"` // Used by Google
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+	Err                     string `json:"error,omitempty"`
+	ErrDesc                 string `json:"error_description,omitempty"`
+}
+
+// DoDeviceAuthorization performs the OAuth 2.0 device authorization grant
+// defined in RFC 8628. The verification url and the user code are printed to
+// stderr, and the token endpoint is polled until the user completes the
+// authorization in any other device, or the device code expires.
+func (o *oauth) DoDeviceAuthorization() (*token, error) {
+	if o.deviceAuthzEndpoint == "" {
+		return nil, errors.New("the provider does not support the device authorization grant: missing 'device_authorization_endpoint' in provider metadata")
+	}
+
+	data := url.Values{}
+	data.Set("client_id", o.clientID)
+	if o.clientSecret != "" {
+		data.Set("client_secret", o.clientSecret)
+	}
+	data.Set("scope", o.scope)
+	resp, err := withRetry(func() (*http.Response, error) {
+		return httpClient.PostForm(o.deviceAuthzEndpoint, data)
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	var da deviceAuthorization
+	if err := json.NewDecoder(resp.Body).Decode(&da); err != nil {
+		return nil, errors.Wrap(err, "error decoding device authorization response")
+	}
+	if da.Err != "" || da.ErrDesc != "" {
+		return nil, errors.Errorf("Error requesting device authorization: %s. %s", da.Err, da.ErrDesc)
+	}
+	if da.DeviceCode == "" {
+		return nil, errors.New("missing 'device_code' in device authorization response")
+	}
+	verificationURI := da.VerificationURI
+	if verificationURI == "" {
+		verificationURI = da.VerificationURL
+	}
+
+	if da.VerificationURIComplete != "" {
+		verificationURI = da.VerificationURIComplete
+	}
+
+	fmt.Fprintln(os.Stderr, "Open a web browser on any device and visit:")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, verificationURI)
+	fmt.Fprintln(os.Stderr)
+	if o.deviceQR {
+		fmt.Fprintln(os.Stderr, "Or scan the QR code:")
+		fmt.Fprintln(os.Stderr)
+		if err := writeQR(os.Stderr, verificationURI); err != nil {
+			return nil, err
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+	fmt.Fprintf(os.Stderr, "And enter the code: %s\n", da.UserCode)
+
+	return o.pollDeviceToken(&da)
+}
+
+// qrQuietZone is the number of light modules around a QR code printed by
+// writeQR.
+const qrQuietZone = 2
+
+// writeQR writes the given text as a QR code using Unicode half blocks, so each
+// line of text has two rows of modules. The light modules are printed with the
+// foreground color, as most terminals use a light text on a dark background.
+func writeQR(w io.Writer, s string) error {
+	code, err := qr.Encode(s, qr.M, qr.Auto)
+	if err != nil {
+		return errors.Wrap(err, "error encoding QR code")
+	}
+	size := code.Bounds().Dx()
+	light := func(x, y int) bool {
+		if x < 0 || y < 0 || x >= size || y >= size {
+			return true
+		}
+		r, _, _, _ := code.At(x, y).RGBA()
+		return r != 0
+	}
+	var buf bytes.Buffer
+	for y := -qrQuietZone; y < size+qrQuietZone; y += 2 {
+		for x := -qrQuietZone; x < size+qrQuietZone; x++ {
+			switch top, bottom := light(x, y), light(x, y+1); {
+			case top && bottom:
+				buf.WriteString("█")
+			case top:
+				buf.WriteString("▀")
+			case bottom:
+				buf.WriteString("▄")
+			default:
+				buf.WriteString(" ")
+			}
+		}
+		buf.WriteString("\n")
+	}
+	_, err = w.Write(buf.Bytes())
+	return errors.WithStack(err)
+}
+
+// pollDeviceToken requests the token using the device code until it is
+// issued, handling the authorization_pending and slow_down errors. Up to 10% of
+// the interval is added to each wait, so clients started at the same time do
+// not poll the token endpoint at the same time.
+func (o *oauth) pollDeviceToken(da *deviceAuthorization) (*token, error) {
+	interval := time.Duration(da.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultDeviceInterval
+	}
+	expiration := time.Duration(da.ExpiresIn) * time.Second
+	if expiration <= 0 {
+		expiration = defaultDeviceExpiration
+	}
+	deadline := time.Now().Add(expiration)
+
+	data := url.Values{}
+	data.Set("grant_type", deviceCodeUrn)
+	data.Set("device_code", da.DeviceCode)
+	data.Set("client_id", o.clientID)
+	if o.clientSecret != "" {
+		data.Set("client_secret", o.clientSecret)
+	}
+
+	for {
+		if time.Now().Add(interval).After(deadline) {
+			return nil, errors.New("the device code expired before the authorization was completed")
+		}
+		deviceSleep(interval + time.Duration(rand.Int63n(int64(interval/10)+1)))
+
+		t := time.Now()
+		resp, err := o.postForm(o.tokenEndpoint, data)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		tok, err := o.decodeToken(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok.Err {
+		case "":
+			if tok.ErrDesc != "" {
+				return nil, errors.Errorf("Error exchanging device code: %s", tok.ErrDesc)
+			}
+			o.recordExchange(time.Since(t))
+			return tok, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += slowDownInterval
+		default:
+			return nil, errors.Errorf("Error exchanging device code: %s. %s", tok.Err, tok.ErrDesc)
+		}
+	}
+}
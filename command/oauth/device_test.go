@@ -0,0 +1,168 @@
+package oauth
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boombuler/barcode/qr"
+	"github.com/smallstep/assert"
+)
+
+func TestDoDeviceAuthorization(t *testing.T) {
+	var sleeps []time.Duration
+	deviceSleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+	}
+	defer func() {
+		deviceSleep = time.Sleep
+	}()
+
+	var deviceForm url.Values
+	var polls []string
+	responses := []string{
+		`{"error":"authorization_pending"}`,
+		`{"error":"slow_down"}`,
+		`{"error":"authorization_pending"}`,
+		`{"access_token":"the-access-token","token_type":"bearer","expires_in":3600}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/device":
+			deviceForm = r.PostForm
+			w.Write([]byte(`{"device_code":"the-device-code","user_code":"ABCD-EFGH","verification_uri":"https://example.org/device","expires_in":600,"interval":1}`))
+		case "/token":
+			polls = append(polls, r.PostForm.Get("grant_type")+" "+r.PostForm.Get("device_code"))
+			if len(polls) < len(responses) {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			w.Write([]byte(responses[len(polls)-1]))
+		}
+	}))
+	defer srv.Close()
+
+	o := &oauth{
+		clientID:            "client-id",
+		scope:               "openid email",
+		deviceAuthzEndpoint: srv.URL + "/device",
+		tokenEndpoint:       srv.URL + "/token",
+	}
+	tok, err := o.DoDeviceAuthorization()
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-access-token", tok.AccessToken)
+	assert.Equals(t, "Bearer", tok.TokenType)
+	assert.Equals(t, "client-id", deviceForm.Get("client_id"))
+	assert.Equals(t, "openid email", deviceForm.Get("scope"))
+	assert.Len(t, 4, polls)
+	assert.Equals(t, deviceCodeUrn+" the-device-code", polls[0])
+	// The interval is increased after slow_down, and a jitter of up to 10% is
+	// added.
+	assert.Len(t, 4, sleeps)
+	for i, d := range []time.Duration{time.Second, time.Second, 6 * time.Second, 6 * time.Second} {
+		assert.True(t, sleeps[i] >= d && sleeps[i] <= d+d/10, sleeps[i])
+	}
+
+	// Other errors stop the polling.
+	polls, sleeps = nil, nil
+	responses = []string{`{"error":"access_denied","error_description":"the user denied the request"}`}
+	_, err = o.DoDeviceAuthorization()
+	assert.Error(t, err)
+	assert.Len(t, 1, polls)
+
+	o.deviceAuthzEndpoint = ""
+	_, err = o.DoDeviceAuthorization()
+	assert.Error(t, err)
+}
+
+func TestWriteQR(t *testing.T) {
+	const s = "https://example.org/device?user_code=ABCD-EFGH"
+	var buf bytes.Buffer
+	assert.FatalError(t, writeQR(&buf, s))
+	code, err := qr.Encode(s, qr.M, qr.Auto)
+	assert.FatalError(t, err)
+
+	// Decode the half blocks and compare them with the modules, including the
+	// quiet zone.
+	size := code.Bounds().Dx()
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Len(t, (size+2*qrQuietZone+1)/2, lines)
+	for i, line := range lines {
+		row := []rune(line)
+		assert.Len(t, size+2*qrQuietZone, row)
+		for j, r := range row {
+			x, y := j-qrQuietZone, 2*i-qrQuietZone
+			top := strings.ContainsRune("█▀", r)
+			bottom := strings.ContainsRune("█▄", r)
+			for k, light := range []bool{top, bottom} {
+				want := true
+				if x >= 0 && x < size && y+k >= 0 && y+k < size {
+					r, _, _, _ := code.At(x, y+k).RGBA()
+					want = r != 0
+				}
+				assert.Equals(t, want, light, x, y+k)
+			}
+		}
+	}
+}
+
+func TestOauthCmdDeviceQR(t *testing.T) {
+	deviceSleep = func(time.Duration) {}
+	defer func() {
+		deviceSleep = time.Sleep
+	}()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/device":
+			w.Write([]byte(`{"device_code":"the-device-code","user_code":"ABCD-EFGH","verification_uri":"https://example.org/device","verification_uri_complete":"https://example.org/device?user_code=ABCD-EFGH","expires_in":600,"interval":1}`))
+		case "/token":
+			w.Write([]byte(`{"access_token":"the-access-token","token_type":"Bearer","expires_in":3600}`))
+		}
+	}))
+	defer srv.Close()
+
+	google := providers["google"]
+	providers["google"] = &providerConfig{
+		AuthorizationEndpoint:       "https://example.org/authorize",
+		TokenEndpoint:               srv.URL + "/token",
+		DeviceAuthorizationEndpoint: srv.URL + "/device",
+	}
+	defer func() {
+		providers["google"] = google
+	}()
+
+	args := []string{"--device", "--bare"}
+	_, stderr, err := runOauth(t, args...)
+	assert.FatalError(t, err)
+	assert.True(t, strings.Contains(stderr, "https://example.org/device?user_code=ABCD-EFGH"), stderr)
+	assert.False(t, strings.Contains(stderr, "█"), stderr)
+
+	stdout, stderr, err := runOauth(t, append(args, "--qr")...)
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-access-token\n", stdout)
+	var qr bytes.Buffer
+	assert.FatalError(t, writeQR(&qr, "https://example.org/device?user_code=ABCD-EFGH"))
+	assert.True(t, strings.Contains(stderr, qr.String()), stderr)
+
+	// --qr requires --device.
+	_, _, err = runOauth(t, "--qr", "--console")
+	assert.Error(t, err)
+}
+
+func TestPollDeviceTokenExpired(t *testing.T) {
+	deviceSleep = func(time.Duration) {}
+	defer func() {
+		deviceSleep = time.Sleep
+	}()
+
+	o := &oauth{clientID: "client-id", tokenEndpoint: "http://127.0.0.1:0/token"}
+	_, err := o.pollDeviceToken(&deviceAuthorization{DeviceCode: "the-device-code", ExpiresIn: 1, Interval: 5})
+	assert.Error(t, err)
+	assert.Equals(t, "the device code expired before the authorization was completed", err.Error())
+}
@@ -0,0 +1,145 @@
+package oauth
+
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/cli/utils"
+)
+
+// tokenTypes maps the short names accepted in the flags to the token type
+// identifiers defined in RFC 8693, section 3.
+var tokenTypes = map[string]string{
+	"access_token":  "urn:ietf:params:oauth:token-type:access_token",
+	"refresh_token": "urn:ietf:params:oauth:token-type:refresh_token",
+	"id_token":      "urn:ietf:params:oauth:token-type:id_token",
+	"jwt":           "urn:ietf:params:oauth:token-type:jwt",
+	"saml1":         "urn:ietf:params:oauth:token-type:saml1",
+	"saml2":         "urn:ietf:params:oauth:token-type:saml2",
+}
+
+// tokenTypeURI returns the token type identifier for the given short name. Any
+// other value is returned as is.
+func tokenTypeURI(s string) string {
+	if uri, ok := tokenTypes[s]; ok {
+		return uri
+	}
+	return s
+}
+
+// detectTokenType returns the short name of the type of the given token: jwt
+// if it has the structure of a JWT, and access_token otherwise.
+func detectTokenType(s string) string {
+	if _, err := decodeJWT(s); err == nil {
+		return "jwt"
+	}
+	return "access_token"
+}
+
+// tokenExchange contains the parameters of a token exchange request.
+type tokenExchange struct {
+	SubjectToken     string
+	SubjectTokenType string
+	ActorToken       string
+	ActorTokenType   string
+	Audience         []string
+	Scope            string
+	RequestedType    string
+}
+
+// DoTokenExchange exchanges a subject token for a new token using the token
+// exchange grant type defined in RFC 8693.
+func (o *oauth) DoTokenExchange(te *tokenExchange) (*token, error) {
+	data := url.Values{}
+	data.Set("grant_type", tokenExchangeUrn)
+	data.Set("subject_token", te.SubjectToken)
+	data.Set("subject_token_type", tokenTypeURI(te.SubjectTokenType))
+	if te.ActorToken != "" {
+		data.Set("actor_token", te.ActorToken)
+		data.Set("actor_token_type", tokenTypeURI(te.ActorTokenType))
+	}
+	for _, aud := range te.Audience {
+		data.Add("audience", aud)
+	}
+	if te.Scope != "" {
+		data.Set("scope", te.Scope)
+	}
+	if te.RequestedType != "" {
+		data.Set("requested_token_type", tokenTypeURI(te.RequestedType))
+	}
+	if o.clientID != "" {
+		data.Set("client_id", o.clientID)
+	}
+	if o.clientSecret != "" {
+		data.Set("client_secret", o.clientSecret)
+	}
+
+	t := time.Now()
+	resp, err := o.postForm(o.tokenEndpoint, data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error from token endpoint")
+	}
+	defer resp.Body.Close()
+	o.recordExchange(time.Since(t))
+
+	tok, err := o.decodeToken(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if tok.Err != "" || tok.ErrDesc != "" {
+		return nil, errors.Errorf("Error exchanging token: %s. %s", tok.Err, tok.ErrDesc)
+	}
+	return tok, nil
+}
+
+// exchangeHop contains the parameters of one of the exchanges in the file
+// passed in --exchange-chain.
+type exchangeHop struct {
+	Audience           []string `json:"audience"`
+	Scope              string   `json:"scope"`
+	RequestedTokenType string   `json:"requested_token_type"`
+}
+
+// readExchangeChain reads the list of exchanges in the given file.
+func readExchangeChain(filename string) ([]exchangeHop, error) {
+	b, err := utils.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var hops []exchangeHop
+	if err := json.Unmarshal(b, &hops); err != nil {
+		return nil, errors.Wrapf(err, "error reading %s: unsupported format", filename)
+	}
+	return hops, nil
+}
+
+// DoTokenExchangeChain runs the given token exchange followed by the given
+// hops, using the token returned by each exchange as the subject token of the
+// next one.
+func (o *oauth) DoTokenExchangeChain(te *tokenExchange, hops []exchangeHop) (*token, error) {
+	tok, err := o.DoTokenExchange(te)
+	if err != nil {
+		return nil, err
+	}
+	for i, hop := range hops {
+		subjectType := tok.IssuedTokenType
+		if subjectType == "" {
+			subjectType = "access_token"
+		}
+		tok, err = o.DoTokenExchange(&tokenExchange{
+			SubjectToken:     tok.AccessToken,
+			SubjectTokenType: subjectType,
+			ActorToken:       te.ActorToken,
+			ActorTokenType:   te.ActorTokenType,
+			Audience:         hop.Audience,
+			Scope:            hop.Scope,
+			RequestedType:    hop.RequestedTokenType,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error in exchange %d of the chain", i+1)
+		}
+	}
+	return tok, nil
+}
@@ -0,0 +1,131 @@
+package oauth
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// httpClient is the client used in the requests to the provider.
+var httpClient = &http.Client{}
+
+// tlsVersions maps the values accepted in --min-tls-version to the TLS version
+// constants.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var (
+	redactForm   = regexp.MustCompile(`(^|[&\n])(client_secret|code|code_verifier|device_code|assertion|subject_token|actor_token|refresh_token|password)=[^&\r\n]*`)
+	redactJSON   = regexp.MustCompile(`"(access_token|id_token|refresh_token|client_secret|device_code|assertion)"(\s*):(\s*)"[^"]*"`)
+	redactHeader = regexp.MustCompile(`(?mi)^(Authorization: \S+) .*$`)
+)
+
+// redact masks the secrets in an HTTP dump.
+func redact(b []byte) []byte {
+	b = redactHeader.ReplaceAll(b, []byte("$1 REDACTED"))
+	b = redactForm.ReplaceAll(b, []byte("${1}${2}=REDACTED"))
+	return redactJSON.ReplaceAll(b, []byte(`"$1"$2:$3"REDACTED"`))
+}
+
+// dumpTransport is an http.RoundTripper that writes the requests and responses
+// to w, masking the client secret, codes, and tokens.
+type dumpTransport struct {
+	w    io.Writer
+	next http.RoundTripper
+}
+
+func (t *dumpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if b, err := httputil.DumpRequestOut(req, true); err == nil {
+		fmt.Fprintf(t.w, "%s\n\n", redact(b))
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if b, err := httputil.DumpResponse(resp, true); err == nil {
+		fmt.Fprintf(t.w, "%s\n\n", redact(b))
+	}
+	return resp, nil
+}
+
+const (
+	// maxRetries is the maximum number of times a rate limited request is
+	// retried.
+	maxRetries = 3
+	// maxRetryAfter is the maximum time to wait before retrying a rate limited
+	// request.
+	maxRetryAfter = time.Minute
+)
+
+// withRetry runs the given request and retries it if the provider responds with
+// a 429 status code and a Retry-After header. The response is returned as is
+// if the wait is longer than maxRetryAfter or after maxRetries retries.
+func withRetry(do func() (*http.Response, error)) (*http.Response, error) {
+	for i := 0; ; i++ {
+		resp, err := do()
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || i == maxRetries {
+			return resp, err
+		}
+		d, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			return resp, nil
+		}
+		resp.Body.Close()
+		fmt.Fprintf(os.Stderr, "Request to %s was rate limited, retrying in %s\n", resp.Request.URL.Host, d)
+		time.Sleep(d)
+	}
+}
+
+// retryAfter parses the value of a Retry-After header, in seconds or as an
+// HTTP date, and returns the time to wait. It returns false if the value
+// cannot be parsed or the wait is longer than maxRetryAfter.
+func retryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if n, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(n) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(now)
+	} else {
+		return 0, false
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d, d <= maxRetryAfter
+}
+
+// setMinTLSVersion sets the minimum TLS version accepted in the requests to
+// the provider. It must be called before enableHTTPDump.
+func setMinTLSVersion(version uint16) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = &tls.Config{
+		MinVersion: version,
+	}
+	httpClient.Transport = tr
+}
+
+// enableHTTPDump writes all the requests to the provider to the standard
+// error.
+func enableHTTPDump() {
+	next := httpClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	httpClient.Transport = &dumpTransport{
+		w:    os.Stderr,
+		next: next,
+	}
+}
@@ -0,0 +1,71 @@
+package oauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/kms"
+	"github.com/smallstep/certificates/kms/apiv1"
+	"github.com/smallstep/cli/jose"
+
+	// Enable the PKCS #11 KMS, it requires cgo.
+	_ "github.com/smallstep/certificates/kms/pkcs11"
+)
+
+// newAssertionSigner returns the signer of the key in the given PKCS #11 uri,
+// used to sign the JWT assertion of a service account. The key manager must
+// be closed after the signer is used.
+func newAssertionSigner(rawuri string) (jose.OpaqueSigner, apiv1.KeyManager, error) {
+	if !strings.HasPrefix(strings.ToLower(rawuri), "pkcs11:") {
+		return nil, nil, errors.Errorf("invalid key uri '%s': it must be a pkcs11 uri", rawuri)
+	}
+	km, err := kms.New(context.Background(), apiv1.Options{
+		Type: string(apiv1.PKCS11),
+		URI:  rawuri,
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error initializing the pkcs11 module")
+	}
+	signer, err := km.CreateSigner(&apiv1.CreateSignerRequest{
+		SigningKey: rawuri,
+	})
+	if err != nil {
+		km.Close()
+		return nil, nil, errors.Wrapf(err, "error loading the key %s", rawuri)
+	}
+	if _, ok := signer.Public().(*rsa.PublicKey); !ok {
+		km.Close()
+		return nil, nil, errors.Errorf("error loading the key %s: the assertion requires an RSA key", rawuri)
+	}
+	return &kmsSigner{signer}, km, nil
+}
+
+// kmsSigner is a jose.OpaqueSigner that creates the RS256 signatures with a
+// crypto.Signer, so the private key never leaves the KMS.
+type kmsSigner struct {
+	signer crypto.Signer
+}
+
+// Public returns the public key of the signer.
+func (s *kmsSigner) Public() *jose.JSONWebKey {
+	return &jose.JSONWebKey{Key: s.signer.Public()}
+}
+
+// Algs returns the supported signature algorithms, only RS256.
+func (s *kmsSigner) Algs() []jose.SignatureAlgorithm {
+	return []jose.SignatureAlgorithm{jose.RS256}
+}
+
+// SignPayload signs the given payload with RS256.
+func (s *kmsSigner) SignPayload(payload []byte, alg jose.SignatureAlgorithm) ([]byte, error) {
+	if alg != jose.RS256 {
+		return nil, errors.Errorf("unsupported signature algorithm %s", alg)
+	}
+	sum := sha256.Sum256(payload)
+	return s.signer.Sign(rand.Reader, sum[:], crypto.SHA256)
+}
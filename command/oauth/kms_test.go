@@ -0,0 +1,55 @@
+package oauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/cli/jose"
+)
+
+func TestNewAssertionSigner(t *testing.T) {
+	_, _, err := newAssertionSigner("/path/to/key.pem")
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "pkcs11 uri"), err.Error())
+
+	// The module path is required.
+	_, _, err = newAssertionSigner("pkcs11:token=oauth;id=1000?pin-value=password")
+	assert.Error(t, err)
+}
+
+func TestKMSSigner(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.FatalError(t, err)
+	o := &oauth{clientID: "the-key-id", tokenEndpoint: "https://example.org/token", scope: "email", assertionSigner: &kmsSigner{priv}}
+
+	raw, err := o.twoLeggedAssertion("service@example.org")
+	assert.FatalError(t, err)
+	jwt, err := jose.ParseSigned(raw)
+	assert.FatalError(t, err)
+	assert.Equals(t, "RS256", jwt.Headers[0].Algorithm)
+	assert.Equals(t, "the-key-id", jwt.Headers[0].KeyID)
+	var claims map[string]interface{}
+	assert.FatalError(t, jwt.Claims(&priv.PublicKey, &claims))
+	assert.Equals(t, "service@example.org", claims["iss"])
+	assert.Equals(t, "https://example.org/token", claims["aud"])
+
+	tok, err := o.DoJWTAuthorization("service@example.org", "https://example.org/api")
+	assert.FatalError(t, err)
+	jwt, err = jose.ParseSigned(tok.AccessToken)
+	assert.FatalError(t, err)
+	assert.FatalError(t, jwt.Claims(&priv.PublicKey, &claims))
+	assert.Equals(t, "https://example.org/api", claims["aud"])
+
+	// Only RS256 is supported.
+	_, err = (&kmsSigner{priv}).SignPayload([]byte("payload"), jose.ES256)
+	assert.Error(t, err)
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	_, err = signJWT(jose.ES256, &kmsSigner{ec}, "", map[string]interface{}{"sub": "1234"})
+	assert.Error(t, err)
+}
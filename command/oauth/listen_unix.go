@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package oauth
+
+import (
+	"syscall"
+)
+
+// reuseAddr sets SO_REUSEADDR in the listener socket, so a fixed port can be
+// bound again while the connections of a previous run are in TIME_WAIT.
+// SO_REUSEPORT is not set, it would allow two concurrent runs to share the
+// port and the callback could be sent to the wrong one.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+package oauth
+
+import (
+	"syscall"
+)
+
+// reuseAddr does nothing on Windows, where SO_REUSEADDR allows other
+// processes to bind the same port and steal the callback.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	return nil
+}
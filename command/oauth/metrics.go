@@ -0,0 +1,38 @@
+package oauth
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// timings holds the duration of the different steps of a flow.
+type timings struct {
+	Discovery time.Duration
+	Exchange  time.Duration
+	Total     time.Duration
+}
+
+// writeMetrics writes the timings of a flow to the given filename using the
+// Prometheus text exposition format, so the file can be collected by the
+// node_exporter textfile collector. The file is replaced atomically on each
+// run, so the collector never reads a partial file.
+func writeMetrics(filename, provider, flow string, t timings) error {
+	labels := fmt.Sprintf("{provider=%s,flow=%s}", strconv.Quote(provider), strconv.Quote(flow))
+
+	var buf bytes.Buffer
+	metric := func(name, help string, d time.Duration) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", name)
+		fmt.Fprintf(&buf, "%s%s %s\n", name, labels, strconv.FormatFloat(d.Seconds(), 'f', -1, 64))
+	}
+	metric("step_oauth_discovery_duration_seconds", "Time spent retrieving the provider discovery document.", t.Discovery)
+	metric("step_oauth_exchange_duration_seconds", "Time spent requesting the token to the token endpoint.", t.Exchange)
+	metric("step_oauth_total_duration_seconds", "Total time spent retrieving the token.", t.Total)
+	fmt.Fprintf(&buf, "# HELP step_oauth_last_success_timestamp_seconds Time of the last successful run.\n")
+	fmt.Fprintf(&buf, "# TYPE step_oauth_last_success_timestamp_seconds gauge\n")
+	fmt.Fprintf(&buf, "step_oauth_last_success_timestamp_seconds%s %d\n", labels, time.Now().Unix())
+
+	return writeFileAtomic(filename, buf.Bytes())
+}
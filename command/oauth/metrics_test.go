@@ -0,0 +1,33 @@
+package oauth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-oauth")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The file is replaced on each run.
+	filename := filepath.Join(dir, "step_oauth.prom")
+	for i := 0; i < 2; i++ {
+		assert.FatalError(t, writeMetrics(filename, "https://example.org", flowLoopback, timings{Exchange: 1500 * time.Millisecond}))
+	}
+	b, err := ioutil.ReadFile(filename)
+	assert.FatalError(t, err)
+	assert.True(t, strings.Contains(string(b), `step_oauth_exchange_duration_seconds{provider="https://example.org",flow="loopback"} 1.5`+"\n"))
+	if runtime.GOOS != "windows" {
+		st, err := os.Stat(filename)
+		assert.FatalError(t, err)
+		assert.Equals(t, os.FileMode(0600), st.Mode().Perm())
+	}
+}
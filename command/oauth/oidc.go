@@ -0,0 +1,61 @@
+package oauth
+
+import (
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// OIDCOptions contains the options used to get an ID token with OIDCToken.
+type OIDCOptions struct {
+	// Provider is the issuer or the discovery document url of the provider.
+	Provider     string
+	ClientID     string
+	ClientSecret string
+	// Listen is the address of the local server used in the loopback flow,
+	// a random port in 127.0.0.1 is used if it is empty.
+	Listen string
+	// Console enables the flow that reads the authorization code from the
+	// terminal instead of starting a local server.
+	Console bool
+	// AuthURLHook, if set, is called with the authorization url before it is
+	// opened in the browser or printed, so the caller can add or sign
+	// parameters.
+	AuthURLHook func(*url.URL) error
+}
+
+// OIDCToken runs the authorization flow with an OpenID Connect provider and
+// returns the ID token. It is equivalent to `step oauth --oidc --bare`, and it
+// can be used by the commands that need the token for an OIDC provisioner
+// without running a new step process and parsing its output.
+func OIDCToken(opts *OIDCOptions) (string, error) {
+	o := &options{
+		Provider:         opts.Provider,
+		Console:          opts.Console,
+		CallbackListener: opts.Listen,
+		CallbackPath:     "/",
+	}
+	if err := o.Validate(); err != nil {
+		return "", err
+	}
+
+	oa, err := newOauth(o.Provider, opts.ClientID, opts.ClientSecret, "", "", "openid email", "", o)
+	if err != nil {
+		return "", err
+	}
+	oa.AuthURLHook = opts.AuthURLHook
+
+	var tok *token
+	if o.Console {
+		tok, err = oa.DoManualAuthorization()
+	} else {
+		tok, err = oa.DoLoopbackAuthorization()
+	}
+	if err != nil {
+		return "", err
+	}
+	if tok.IDToken == "" {
+		return "", errors.New("the provider did not return an ID token")
+	}
+	return tok.IDToken, nil
+}
@@ -0,0 +1,146 @@
+package oauth_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/cli/command/oauth"
+)
+
+// newTestProvider returns an OpenID Connect provider that issues an ID token
+// for the authorization code "the-code". The default transport trusts its
+// certificate until the returned function is called.
+func newTestProvider(t *testing.T) (*httptest.Server, func()) {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 srv.URL,
+				"authorization_endpoint": srv.URL + "/authorize",
+				"token_endpoint":         srv.URL + "/token",
+				"jwks_uri":               srv.URL + "/jwks",
+			})
+		case "/token":
+			r.ParseForm()
+			if r.PostForm.Get("code") != "the-code" || r.PostForm.Get("client_id") != "client-id" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+			w.Write([]byte(`{"access_token":"the-access-token","id_token":"the-id-token","token_type":"Bearer","expires_in":3600}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	transport := http.DefaultTransport
+	http.DefaultTransport = srv.Client().Transport
+	return srv, func() {
+		http.DefaultTransport = transport
+		srv.Close()
+	}
+}
+
+// withConsole replaces the standard input with the given input, and the
+// standard error with a file that can be read with the returned function.
+func withConsole(t *testing.T, input string) func() string {
+	t.Helper()
+	stdin, stderr := os.Stdin, os.Stderr
+	r, w, err := os.Pipe()
+	assert.FatalError(t, err)
+	_, err = w.Write([]byte(input))
+	assert.FatalError(t, err)
+	w.Close()
+	f, err := ioutil.TempFile("", "step-oauth-stderr")
+	assert.FatalError(t, err)
+	os.Stdin, os.Stderr = r, f
+	return func() string {
+		os.Stdin, os.Stderr = stdin, stderr
+		r.Close()
+		f.Close()
+		defer os.Remove(f.Name())
+		b, err := ioutil.ReadFile(f.Name())
+		assert.FatalError(t, err)
+		return string(b)
+	}
+}
+
+func TestOIDCToken(t *testing.T) {
+	srv, closeProvider := newTestProvider(t)
+	defer closeProvider()
+
+	restore := withConsole(t, "the-code\n")
+	idToken, err := oauth.OIDCToken(&oauth.OIDCOptions{
+		Provider:     srv.URL,
+		ClientID:     "client-id",
+		ClientSecret: "client-secret",
+		Console:      true,
+	})
+	restore()
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-id-token", idToken)
+
+	restore = withConsole(t, "a-bad-code\n")
+	_, err = oauth.OIDCToken(&oauth.OIDCOptions{
+		Provider: srv.URL,
+		ClientID: "client-id",
+		Console:  true,
+	})
+	restore()
+	assert.Error(t, err)
+
+	_, err = oauth.OIDCToken(&oauth.OIDCOptions{Provider: "http://example.org", ClientID: "client-id"})
+	assert.Error(t, err)
+}
+
+func TestOIDCTokenAuthURLHook(t *testing.T) {
+	srv, closeProvider := newTestProvider(t)
+	defer closeProvider()
+
+	var authURL *url.URL
+	restore := withConsole(t, "the-code\n")
+	idToken, err := oauth.OIDCToken(&oauth.OIDCOptions{
+		Provider: srv.URL,
+		ClientID: "client-id",
+		Console:  true,
+		AuthURLHook: func(u *url.URL) error {
+			q := u.Query()
+			q.Set("signature", "the-signature")
+			u.RawQuery = q.Encode()
+			authURL = u
+			return nil
+		},
+	})
+	stderr := restore()
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-id-token", idToken)
+	assert.Equals(t, srv.URL+"/authorize", authURL.Scheme+"://"+authURL.Host+authURL.Path)
+	assert.Equals(t, "client-id", authURL.Query().Get("client_id"))
+	// The modified url is the one printed.
+	assert.True(t, strings.Contains(stderr, authURL.String()))
+	assert.True(t, strings.Contains(stderr, "signature=the-signature"))
+
+	restore = withConsole(t, "the-code\n")
+	_, err = oauth.OIDCToken(&oauth.OIDCOptions{
+		Provider: srv.URL,
+		ClientID: "client-id",
+		Console:  true,
+		AuthURLHook: func(u *url.URL) error {
+			return errors.New("hook failed")
+		},
+	})
+	restore()
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "hook failed"))
+}
@@ -0,0 +1,192 @@
+package oauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/cli/errs"
+)
+
+// writeOutput writes the output of the command to the given filename, or to
+// the standard output if filename is empty. If the file is a named pipe
+// (FIFO), it blocks until a reader opens it and the data is written as is.
+// Regular files are replaced without prompting, so scheduled runs can rewrite
+// them.
+func writeOutput(filename string, b []byte) error {
+	if filename == "" {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+
+	if st, err := os.Stat(filename); err == nil && st.Mode()&os.ModeNamedPipe != 0 {
+		f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+		if err != nil {
+			return errs.FileError(err, filename)
+		}
+		if _, err := f.Write(b); err != nil {
+			f.Close()
+			return errs.FileError(err, filename)
+		}
+		if err := f.Close(); err != nil {
+			return errs.FileError(err, filename)
+		}
+		return nil
+	}
+
+	return writeFileAtomic(filename, b)
+}
+
+// writeFileAtomic writes the data to a temporary file in the same directory and
+// renames it to filename, so readers like the AWS SDKs, that read the file
+// again on each refresh, never see a partial token. The file is created with
+// 0600 permissions, and an existing one is replaced without prompting.
+func writeFileAtomic(filename string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return errs.FileError(err, filename)
+	}
+	tmp := f.Name()
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errs.FileError(err, filename)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errs.FileError(err, filename)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return errs.FileError(err, filename)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return errs.FileError(err, filename)
+	}
+	return nil
+}
+
+// Formats of the access token in the output of --describe.
+const (
+	accessTokenJWT    = "jwt"
+	accessTokenOpaque = "opaque token"
+)
+
+// tokenDescription is the output of --describe. It must never include the
+// tokens.
+type tokenDescription struct {
+	TokenType         string          `json:"token_type"`
+	Scope             string          `json:"scope,omitempty"`
+	IssuedTokenType   string          `json:"issued_token_type,omitempty"`
+	ExpiresIn         int             `json:"expires_in,omitempty"`
+	ExpiresAt         *time.Time      `json:"expires_at,omitempty"`
+	AccessTokenFormat string          `json:"access_token_format"`
+	AccessTokenClaims json.RawMessage `json:"access_token_claims,omitempty"`
+	IDToken           bool            `json:"id_token"`
+	RefreshToken      bool            `json:"refresh_token"`
+}
+
+// describe returns the description of a token issued at the given time.
+func describe(tok *token, issuedAt time.Time) *tokenDescription {
+	d := &tokenDescription{
+		TokenType:       tok.TokenType,
+		Scope:           tok.Scope,
+		IssuedTokenType: tok.IssuedTokenType,
+		ExpiresIn:       tok.ExpiresIn,
+		IDToken:         tok.IDToken != "",
+		RefreshToken:    tok.RefreshToken != "",
+	}
+	// Many providers issue JWT access tokens, their claims are useful to
+	// debug authorization issues.
+	if dec, err := decodeJWT(tok.AccessToken); err == nil {
+		d.AccessTokenFormat = accessTokenJWT
+		d.AccessTokenClaims = dec.Payload
+	} else {
+		d.AccessTokenFormat = accessTokenOpaque
+	}
+	if tok.ExpiresIn > 0 {
+		t := issuedAt.Add(time.Duration(tok.ExpiresIn) * time.Second).UTC().Truncate(time.Second)
+		d.ExpiresAt = &t
+	}
+	return d
+}
+
+// envFile returns the given token in the dotenv format used by docker.
+func envFile(tok *token) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "ACCESS_TOKEN=%s\n", tok.AccessToken)
+	fmt.Fprintf(&buf, "TOKEN_TYPE=%s\n", tok.TokenType)
+	if tok.IDToken != "" {
+		fmt.Fprintf(&buf, "ID_TOKEN=%s\n", tok.IDToken)
+	}
+	if tok.ExpiresIn > 0 {
+		fmt.Fprintf(&buf, "EXPIRES_IN=%d\n", tok.ExpiresIn)
+	}
+	return buf.Bytes()
+}
+
+// authorization returns the value of the Authorization header for the access
+// token using its token type, or for the ID token if idToken is true. ID
+// tokens are always bearer tokens.
+func authorization(tok *token, idToken bool) string {
+	if idToken {
+		return "Bearer " + tok.IDToken
+	}
+	return normalizeTokenType(tok.TokenType) + " " + tok.AccessToken
+}
+
+// curlConfig returns the Authorization header with the given value in the
+// format of a curl config file.
+func curlConfig(authz string) []byte {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return []byte(fmt.Sprintf("header = \"Authorization: %s\"\n", r.Replace(authz)))
+}
+
+// gitCredential returns the given access token in the format of the git
+// credential helper protocol.
+func gitCredential(tok string) []byte {
+	return []byte(fmt.Sprintf("username=oauth2\npassword=%s\n", tok))
+}
+
+// isLoopbackURL returns true if the given url is an http or https url using
+// localhost or a loopback IP address.
+func isLoopbackURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// postResult sends the given token as JSON to the url set in
+// --result-callback.
+func postResult(u string, tok *token) error {
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling token data")
+	}
+	resp, err := httpClient.Post(u, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrapf(err, "error sending the token to %s", u)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("error sending the token to %s: %s", u, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package oauth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+)
+
+func TestWriteOutputFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-oauth")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "token")
+	assert.FatalError(t, writeOutput(filename, []byte("the-token\n")))
+	b, err := ioutil.ReadFile(filename)
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-token\n", string(b))
+
+	// Existing files are replaced without prompting.
+	assert.FatalError(t, writeOutput(filename, []byte("the-new-token\n")))
+	b, err = ioutil.ReadFile(filename)
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-new-token\n", string(b))
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-oauth")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "web-identity-token")
+	assert.FatalError(t, ioutil.WriteFile(filename, []byte("the-old-token"), 0644))
+	assert.FatalError(t, writeFileAtomic(filename, []byte("the-id-token")))
+	b, err := ioutil.ReadFile(filename)
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-id-token", string(b))
+
+	// The temporary file is renamed.
+	files, err := ioutil.ReadDir(dir)
+	assert.FatalError(t, err)
+	assert.Len(t, 1, files)
+
+	assert.Error(t, writeFileAtomic(filepath.Join(dir, "missing", "token"), []byte("the-id-token")))
+}
+
+func TestDescribe(t *testing.T) {
+	issuedAt := time.Date(2020, 1, 2, 3, 4, 5, 600, time.UTC)
+	tok := &token{
+		AccessToken:  "the-access-token",
+		RefreshToken: "the-refresh-token",
+		TokenType:    "Bearer",
+		Scope:        "openid email",
+		ExpiresIn:    3600,
+	}
+	b, err := json.Marshal(describe(tok, issuedAt))
+	assert.FatalError(t, err)
+	assert.Equals(t, `{"token_type":"Bearer","scope":"openid email","expires_in":3600,"expires_at":"2020-01-02T04:04:05Z","access_token_format":"opaque token","id_token":false,"refresh_token":true}`, string(b))
+
+	b, err = json.Marshal(describe(&token{AccessToken: "the-access-token", TokenType: "Bearer"}, issuedAt))
+	assert.FatalError(t, err)
+	assert.Equals(t, `{"token_type":"Bearer","access_token_format":"opaque token","id_token":false,"refresh_token":false}`, string(b))
+
+	jwt := "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(`{"scope":"read","aud":"api"}`)) + ".c2lnbmF0dXJl"
+	b, err = json.Marshal(describe(&token{AccessToken: jwt, TokenType: "Bearer"}, issuedAt))
+	assert.FatalError(t, err)
+	assert.Equals(t, `{"token_type":"Bearer","access_token_format":"jwt","access_token_claims":{"scope":"read","aud":"api"},"id_token":false,"refresh_token":false}`, string(b))
+}
+
+func TestEnvFile(t *testing.T) {
+	assert.Equals(t, "ACCESS_TOKEN=the-access-token\nTOKEN_TYPE=Bearer\nID_TOKEN=the-id-token\nEXPIRES_IN=3600\n", string(envFile(&token{
+		AccessToken:  "the-access-token",
+		IDToken:      "the-id-token",
+		RefreshToken: "the-refresh-token",
+		TokenType:    "Bearer",
+		ExpiresIn:    3600,
+	})))
+	assert.Equals(t, "ACCESS_TOKEN=the-access-token\nTOKEN_TYPE=Bearer\n", string(envFile(&token{
+		AccessToken: "the-access-token",
+		TokenType:   "Bearer",
+	})))
+}
+
+func TestAuthorization(t *testing.T) {
+	tok := &token{AccessToken: "the-access-token", IDToken: "the-id-token", TokenType: "DPoP"}
+	assert.Equals(t, "DPoP the-access-token", authorization(tok, false))
+	assert.Equals(t, "Bearer the-id-token", authorization(tok, true))
+	tok.TokenType = ""
+	assert.Equals(t, "Bearer the-access-token", authorization(tok, false))
+	tok.TokenType = "bearer"
+	assert.Equals(t, "Bearer the-access-token", authorization(tok, false))
+}
+
+func TestCurlConfig(t *testing.T) {
+	assert.Equals(t, "header = \"Authorization: Bearer the-token\"\n", string(curlConfig("Bearer the-token")))
+	assert.Equals(t, "header = \"Authorization: DPoP the-token\"\n", string(curlConfig(authorization(&token{AccessToken: "the-token", TokenType: "DPoP"}, false))))
+	assert.Equals(t, `header = "Authorization: Bearer a\"b\\c"`+"\n", string(curlConfig(`Bearer a"b\c`)))
+}
+
+func TestGitCredential(t *testing.T) {
+	assert.Equals(t, "username=oauth2\npassword=the-token\n", string(gitCredential("the-token")))
+}
+
+func TestIsLoopbackURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"http://localhost:8080/token", true},
+		{"http://127.0.0.1:8080/token", true},
+		{"https://[::1]:8080", true},
+		{"http://example.org/token", false},
+		{"http://10.0.0.1:8080/token", false},
+		{"ftp://127.0.0.1/token", false},
+		{"127.0.0.1:8080", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			assert.Equals(t, tt.want, isLoopbackURL(tt.url))
+		})
+	}
+}
+
+func TestPostResult(t *testing.T) {
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/token" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer srv.Close()
+
+	assert.FatalError(t, postResult(srv.URL+"/token", &token{AccessToken: "the-access-token", TokenType: "Bearer"}))
+	assert.Equals(t, "the-access-token", body["access_token"])
+	assert.Error(t, postResult(srv.URL+"/other", &token{AccessToken: "the-access-token"}))
+}
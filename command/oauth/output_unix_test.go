@@ -0,0 +1,46 @@
+//go:build !windows
+// +build !windows
+
+package oauth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/smallstep/assert"
+)
+
+func TestWriteOutputFIFO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-oauth")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	fifo := filepath.Join(dir, "token")
+	assert.FatalError(t, syscall.Mkfifo(fifo, 0600))
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- writeOutput(fifo, []byte("the-token\n"))
+	}()
+
+	b, err := ioutil.ReadFile(fifo)
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-token\n", string(b))
+	assert.NoError(t, <-errCh)
+}
+
+func TestWriteOutputPermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-oauth")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "token")
+	assert.FatalError(t, ioutil.WriteFile(filename, []byte("the-old-token"), 0644))
+	assert.FatalError(t, writeOutput(filename, []byte("the-token\n")))
+	st, err := os.Stat(filename)
+	assert.FatalError(t, err)
+	assert.Equals(t, os.FileMode(0600), st.Mode().Perm())
+}
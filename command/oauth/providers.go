@@ -0,0 +1,110 @@
+package oauth
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// providerConfig contains the endpoints of a provider that can be referenced
+// by name in the --provider flag.
+type providerConfig struct {
+	AuthorizationEndpoint string
+	TokenEndpoint         string
+	UserInfoEndpoint      string
+	// DeviceAuthorizationEndpoint is used in the device flow, it is empty if
+	// the provider does not support it.
+	DeviceAuthorizationEndpoint string
+	// TokenMapper converts the responses of the token endpoint if they do not
+	// use the standard format. It is replaced by --token-response-path.
+	TokenMapper tokenMapper
+}
+
+// tokenMapper converts the body of a token endpoint response into a token.
+type tokenMapper func(b []byte) (*token, error)
+
+// nestedTokenMapper returns a tokenMapper for responses where the token fields
+// are in a nested object. For example, nestedTokenMapper("data") reads the
+// access token from data.access_token.
+func nestedTokenMapper(keys ...string) tokenMapper {
+	return func(b []byte) (*token, error) {
+		for _, k := range keys {
+			var m map[string]json.RawMessage
+			if err := json.Unmarshal(b, &m); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			v, ok := m[k]
+			if !ok {
+				// Errors usually use the standard format.
+				break
+			}
+			b = v
+		}
+		var tok token
+		if err := json.Unmarshal(b, &tok); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return &tok, nil
+	}
+}
+
+// providers is the registry of the providers that do not require discovery.
+// Any other provider must be set using its issuer url.
+var providers = map[string]*providerConfig{
+	"google": {
+		AuthorizationEndpoint:       "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenEndpoint:               "https://www.googleapis.com/oauth2/v4/token",
+		UserInfoEndpoint:            "https://www.googleapis.com/oauth2/v3/userinfo",
+		DeviceAuthorizationEndpoint: "https://oauth2.googleapis.com/device/code",
+	},
+}
+
+// providerNames returns the sorted list of the names in the registry.
+func providerNames() string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// decodeToken reads a token from the response of the token endpoint, using
+// the token mapper of the provider if there is one. The token type is
+// normalized with normalizeTokenType.
+func (o *oauth) decodeToken(r io.Reader) (*token, error) {
+	var tok *token
+	if o.tokenMapper == nil {
+		tok = new(token)
+		if err := json.NewDecoder(r).Decode(tok); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	} else {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if tok, err = o.tokenMapper(b); err != nil {
+			return nil, err
+		}
+	}
+	if tok.AccessToken != "" {
+		tok.TokenType = normalizeTokenType(tok.TokenType)
+	}
+	return tok, nil
+}
+
+// normalizeTokenType returns "Bearer" if the given token type is empty or a
+// different capitalization of it. Token types are case-insensitive, as defined
+// in RFC 6749, section 5.1, but some consumers are not. Other values are
+// returned as is.
+func normalizeTokenType(s string) string {
+	if s == "" || strings.EqualFold(s, "bearer") {
+		return "Bearer"
+	}
+	return s
+}
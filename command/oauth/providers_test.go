@@ -0,0 +1,82 @@
+package oauth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/smallstep/assert"
+)
+
+func TestNewOauthRegisteredProvider(t *testing.T) {
+	for name, p := range providers {
+		t.Run(name, func(t *testing.T) {
+			o, err := newOauth(name, "client-id", "client-secret", "", "", "openid", "", &options{Provider: name, CallbackPath: "/"})
+			assert.FatalError(t, err)
+			assert.Equals(t, p.AuthorizationEndpoint, o.authzEndpoint)
+			assert.Equals(t, p.TokenEndpoint, o.tokenEndpoint)
+			assert.Equals(t, p.UserInfoEndpoint, o.userInfoEndpoint)
+		})
+	}
+}
+
+func TestNestedTokenMapper(t *testing.T) {
+	mapper := nestedTokenMapper("data")
+	tests := []struct {
+		name    string
+		body    string
+		want    *token
+		wantErr bool
+	}{
+		{"ok nested", `{"data":{"access_token":"the-access-token","token_type":"Bearer","expires_in":3600}}`, &token{AccessToken: "the-access-token", TokenType: "Bearer", ExpiresIn: 3600}, false},
+		{"ok error", `{"error":"invalid_grant","error_description":"bad code"}`, &token{Err: "invalid_grant", ErrDesc: "bad code"}, false},
+		{"fail json", `not-json`, nil, true},
+		{"fail nested json", `{"data":"the-access-token"}`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tok, err := mapper([]byte(tt.body))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.FatalError(t, err)
+			assert.Equals(t, tt.want, tok)
+		})
+	}
+}
+
+func TestNewOauthTokenResponsePath(t *testing.T) {
+	o, err := newOauth("google", "client-id", "client-secret", "", "", "openid", "", &options{Provider: "google", CallbackPath: "/", TokenResponsePath: "data.token"})
+	assert.FatalError(t, err)
+	tok, err := o.decodeToken(strings.NewReader(`{"data":{"token":{"access_token":"the-access-token","expires_in":3600}}}`))
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-access-token", tok.AccessToken)
+	assert.Equals(t, 3600, tok.ExpiresIn)
+
+	// Without the flag the standard format is used.
+	o, err = newOauth("google", "client-id", "client-secret", "", "", "openid", "", &options{Provider: "google", CallbackPath: "/"})
+	assert.FatalError(t, err)
+	tok, err = o.decodeToken(strings.NewReader(`{"access_token":"the-access-token"}`))
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-access-token", tok.AccessToken)
+}
+
+func TestDecodeTokenMapper(t *testing.T) {
+	o := &oauth{tokenMapper: nestedTokenMapper("data")}
+	tok, err := o.decodeToken(strings.NewReader(`{"data":{"access_token":"the-access-token"}}`))
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-access-token", tok.AccessToken)
+
+	o.tokenMapper = nil
+	tok, err = o.decodeToken(strings.NewReader(`{"access_token":"the-access-token"}`))
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-access-token", tok.AccessToken)
+}
+
+func TestNormalizeTokenType(t *testing.T) {
+	assert.Equals(t, "Bearer", normalizeTokenType(""))
+	assert.Equals(t, "Bearer", normalizeTokenType("bearer"))
+	assert.Equals(t, "Bearer", normalizeTokenType("BEARER"))
+	assert.Equals(t, "DPoP", normalizeTokenType("DPoP"))
+	assert.Equals(t, "N_A", normalizeTokenType("N_A"))
+}
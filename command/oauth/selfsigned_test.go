@@ -0,0 +1,49 @@
+package oauth
+
+import (
+	"testing"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/cli/jose"
+)
+
+func TestParseClaims(t *testing.T) {
+	claims, err := parseClaims([]string{"aud=my-service", "email_verified=true", "age=42", "groups=[\"a\",\"b\"]", "note=a=b"})
+	assert.FatalError(t, err)
+	assert.Equals(t, map[string]interface{}{
+		"aud":            "my-service",
+		"email_verified": true,
+		"age":            float64(42),
+		"groups":         []interface{}{"a", "b"},
+		"note":           "a=b",
+	}, claims)
+
+	_, err = parseClaims([]string{"aud"})
+	assert.Error(t, err)
+	_, err = parseClaims([]string{"=value"})
+	assert.Error(t, err)
+}
+
+func TestDoSelfSignedAuthorization(t *testing.T) {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "the-kid", 0)
+	assert.FatalError(t, err)
+
+	o := &oauth{}
+	tok, err := o.DoSelfSignedAuthorization(jwk, map[string]interface{}{"aud": "my-service", "sub": "jane"})
+	assert.FatalError(t, err)
+	assert.Equals(t, tok.AccessToken, tok.IDToken)
+	assert.Equals(t, 3600, tok.ExpiresIn)
+
+	jwt, err := jose.ParseSigned(tok.IDToken)
+	assert.FatalError(t, err)
+	assert.Equals(t, "the-kid", jwt.Headers[0].KeyID)
+	var claims jose.Claims
+	assert.FatalError(t, jwt.Claims(jwk.Public().Key, &claims))
+	assert.Equals(t, "step-oauth", claims.Issuer)
+	assert.Equals(t, "jane", claims.Subject)
+	assert.Equals(t, jose.Audience{"my-service"}, claims.Audience)
+
+	pub := jwk.Public()
+	_, err = o.DoSelfSignedAuthorization(&pub, nil)
+	assert.Error(t, err)
+}
@@ -92,6 +92,10 @@ type SigningKey = jose.SigningKey
 // SignerOptions represents options that can be set when creating signers.
 type SignerOptions = jose.SignerOptions
 
+// OpaqueSigner represents a signer whose private key is not available, for
+// example a key in a hardware module.
+type OpaqueSigner = jose.OpaqueSigner
+
 // Header represents the read-only JOSE header for JWE/JWS objects.
 type Header = jose.Header
 